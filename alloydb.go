@@ -0,0 +1,62 @@
+// Copyright IBM Corp. 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package pgmultiauth
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"cloud.google.com/go/alloydbconn"
+	"github.com/jackc/pgx/v5"
+)
+
+// alloyDBDialer is the subset of *alloydbconn.Dialer used to connect
+// to AlloyDB instances.
+type alloyDBDialer interface {
+	Dial(ctx context.Context, instance string, opts ...alloydbconn.DialOption) (net.Conn, error)
+	Close() error
+}
+
+// newAlloyDBDialer creates the dialer used by the AlloyDB connector.
+// It is a variable so that tests can avoid calling the AlloyDB Admin API.
+var newAlloyDBDialer = func(ctx context.Context, opts ...alloydbconn.Option) (alloyDBDialer, error) {
+	return alloydbconn.NewDialer(ctx, opts...)
+}
+
+// installAlloyDBDialer replaces the dial function of connConfig with one
+// connecting to the configured AlloyDB instance. Like the Cloud SQL dialer,
+// it handles TLS and IAM database authentication itself.
+func (c Config) installAlloyDBDialer(ctx context.Context, connConfig *pgx.ConnConfig) error {
+	opts := append([]alloydbconn.Option{alloydbconn.WithIAMAuthN()}, c.alloyDBOpts...)
+	dialer, err := newAlloyDBDialer(ctx, opts...)
+	if err != nil {
+		return fmt.Errorf("creating alloydb dialer: %w", err)
+	}
+
+	if err := c.resources.track(dialer); err != nil {
+		return fmt.Errorf("creating alloydb dialer: %w", err)
+	}
+
+	instance := c.alloyDBInstance
+	connConfig.DialFunc = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dialer.Dial(ctx, instance)
+	}
+	connConfig.LookupFunc = func(_ context.Context, host string) ([]string, error) {
+		return []string{host}, nil
+	}
+	connConfig.TLSConfig = nil
+	connConfig.Fallbacks = nil
+	connConfig.Password = ""
+
+	return nil
+}
+
+func validateAlloyDBConfig(instanceURI string) error {
+	if instanceURI == "" {
+		return fmt.Errorf("instance URI is required for the AlloyDB connector")
+	}
+
+	return nil
+}
@@ -5,42 +5,103 @@ package pgmultiauth
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/feature/rds/auth"
 )
 
+// awsTokenLifetime is how long RDS IAM auth tokens are valid for.
+const awsTokenLifetime = 15 * time.Minute
+
 type awsTokenConfig struct {
 	host      string
 	port      uint16
 	user      string
 	awsConfig *aws.Config
+
+	// dbUser overrides user for the token and the connection when set
+	dbUser string
+
+	refreshBuffer time.Duration
+	clock         func() time.Time
+
+	// err is the error resolving the endpoint, returned instead of a token
+	err error
+}
+
+// awsTokenConfig returns the AWS provider of the Config, signing tokens for
+// the endpoint returned by awsTokenEndpoint.
+func (c Config) awsTokenConfig() awsTokenConfig {
+	tc := awsTokenConfig{
+		dbUser:        c.awsUser,
+		awsConfig:     c.awsConfig,
+		refreshBuffer: c.tokenRefreshBuffer,
+		clock:         c.now(),
+	}
+
+	connConfig, err := c.parseConnConfig()
+	if err != nil {
+		tc.err = fmt.Errorf("failed to parse connection string: %w", err)
+		return tc
+	}
+
+	tc.user = connConfig.User
+	tc.host, tc.port, tc.err = c.awsTokenEndpoint()
+	return tc
+}
+
+// validate checks the AWS config and that the endpoint can be signed for.
+// Errors parsing the connection string are left to Open and the other
+// functions using the Config.
+func (c awsTokenConfig) validate() error {
+	if err := validateAWSConfig(c.awsConfig); err != nil {
+		return fmt.Errorf("invalid AWS config: %w", err)
+	}
+
+	if errors.Is(c.err, errAWSSocketHost) || errors.Is(c.err, errAWSMultiHost) {
+		return fmt.Errorf("invalid AWS config: %w", c.err)
+	}
+
+	return nil
 }
 
 func (c awsTokenConfig) generateToken(ctx context.Context) (*authToken, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+
 	token, err := c.fetchAWSAuthToken(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("fetching aws token: %v", err)
+		return nil, fmt.Errorf("fetching aws token: %w", err)
 	}
 
-	// The token is valid for 15 minutes, so we set the expiry time to 14 minutes
-	// to account for network delays
-	expiry := time.Now().Add(14 * time.Minute)
-	validFn := func() bool { return time.Now().Before(expiry) }
+	// The token is valid for 15 minutes, so we consider it expired refreshBuffer
+	// earlier to account for network delays
+	expiry := c.clock().Add(awsTokenLifetime)
+	validFn := validBefore(c.clock, expiry, c.refreshBuffer)
 
-	return &authToken{token: token, valid: validFn}, nil
+	return &authToken{token: token, username: c.dbUser, valid: validFn, expiresAt: expiry}, nil
 }
 
 func (c awsTokenConfig) fetchAWSAuthToken(ctx context.Context) (string, error) {
 	creds := c.awsConfig.Credentials
 	region := c.awsConfig.Region
 
+	user := c.user
+	if c.dbUser != "" {
+		user = c.dbUser
+	}
+
 	authToken, err := auth.BuildAuthToken(ctx,
 		fmt.Sprintf("%s:%d", c.host, c.port),
 		region,
-		c.user,
+		user,
 		creds,
 	)
 	if err != nil {
@@ -50,6 +111,20 @@ func (c awsTokenConfig) fetchAWSAuthToken(ctx context.Context) (string, error) {
 	return authToken, nil
 }
 
+// assumeAWSRole returns a copy of cfg whose credentials are obtained by
+// assuming roleARN with the credentials of cfg. This allows signing auth
+// tokens for an RDS instance that lives in another AWS account.
+func assumeAWSRole(cfg aws.Config, client stscreds.AssumeRoleAPIClient, roleARN, externalID string) aws.Config {
+	provider := stscreds.NewAssumeRoleProvider(client, roleARN, func(o *stscreds.AssumeRoleOptions) {
+		if externalID != "" {
+			o.ExternalID = aws.String(externalID)
+		}
+	})
+
+	cfg.Credentials = aws.NewCredentialsCache(provider)
+	return cfg
+}
+
 func validateAWSConfig(awsConfig *aws.Config) error {
 	if awsConfig == nil {
 		return fmt.Errorf("aws config is required for AWS authentication")
@@ -65,3 +140,45 @@ func validateAWSConfig(awsConfig *aws.Config) error {
 
 	return nil
 }
+
+// rdsHostSuffixes are the domain suffixes of RDS endpoints, including Aurora
+// clusters and RDS Proxy, in the AWS partitions.
+var rdsHostSuffixes = []string{".rds.amazonaws.com", ".rds.amazonaws.com.cn"}
+
+// awsRegionPattern matches AWS region names, e.g. "us-west-2" or "us-gov-west-1".
+var awsRegionPattern = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+$`)
+
+// regionFromRDSHost returns the region of an RDS endpoint host like
+// "<id>.<hash>.<region>.rds.amazonaws.com". It reports false if host isn't an
+// RDS endpoint.
+func regionFromRDSHost(host string) (string, bool) {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	for _, suffix := range rdsHostSuffixes {
+		prefix, ok := strings.CutSuffix(host, suffix)
+		if !ok {
+			continue
+		}
+
+		region := prefix[strings.LastIndex(prefix, ".")+1:]
+		if awsRegionPattern.MatchString(region) {
+			return region, true
+		}
+	}
+
+	return "", false
+}
+
+// errAWSSocketHost is returned when AWS tokens would be signed for a Unix
+// domain socket.
+var errAWSSocketHost = errors.New("AWS IAM authentication requires a TCP endpoint")
+
+// errAWSMultiHost is returned when AWS tokens would be sent to several hosts
+// of a multi-host connection string.
+var errAWSMultiHost = errors.New("AWS IAM authentication tokens are signed for a single endpoint")
+
+// isUnixSocketHost checks if host is the directory of a Unix domain socket,
+// e.g. "/cloudsql/project:region:instance", rather than a TCP host.
+func isUnixSocketHost(host string) bool {
+	return strings.HasPrefix(host, "/")
+}
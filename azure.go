@@ -12,26 +12,66 @@ import (
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
 )
 
+// defaultAzureScope is the token scope of Azure Database for PostgreSQL
+// in the Azure public cloud.
+const defaultAzureScope = "https://ossrdbms-aad.database.windows.net/.default"
+
 type azureTokenConfig struct {
 	creds azcore.TokenCredential
+
+	// scopes default to the scope of cloud when empty
+	scopes []string
+	cloud  AzureCloud
+
+	// user overrides the user of the connection when set
+	user string
+
+	refreshBuffer time.Duration
+	clock         func() time.Time
 }
 
 func (c azureTokenConfig) generateToken(ctx context.Context) (*authToken, error) {
 	token, err := c.fetchAzureAuthToken(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("fetching azure token: %v", err)
+		return nil, fmt.Errorf("fetching azure token: %w", err)
 	}
 
-	// Set expiry to 1 minute before actual expiry to account for network latency
-	expiryTime := token.ExpiresOn.Add(-1 * time.Minute)
-	validFn := func() bool { return time.Now().Before(expiryTime) }
+	validFn := validBefore(c.clock, c.refreshAt(token), 0)
 
-	return &authToken{token: token.Token, valid: validFn}, nil
+	return &authToken{token: token.Token, username: c.user, valid: validFn, expiresAt: token.ExpiresOn}, nil
+}
+
+// refreshAt returns when a new token should be requested for token. Usually
+// that is refreshBuffer before the token expires, to account for network
+// latency. Requesting a token earlier is redundant since credentials return
+// their cached token until the RefreshOn they suggest, and a token that is
+// already within refreshBuffer of its expiry is used until it expires.
+func (c azureTokenConfig) refreshAt(token azcore.AccessToken) time.Time {
+	refreshAt := token.ExpiresOn.Add(-c.refreshBuffer)
+	if token.RefreshOn.After(refreshAt) {
+		refreshAt = token.RefreshOn
+	}
+
+	now := time.Now
+	if c.clock != nil {
+		now = c.clock
+	}
+
+	if !refreshAt.After(now()) || refreshAt.After(token.ExpiresOn) {
+		refreshAt = token.ExpiresOn
+	}
+
+	return refreshAt
 }
 
 func (c azureTokenConfig) fetchAzureAuthToken(ctx context.Context) (azcore.AccessToken, error) {
+	scopes := c.scopes
+	if len(scopes) == 0 {
+		scopes = []string{c.cloud.scope()}
+	}
+
 	token, err := c.creds.GetToken(ctx, policy.TokenRequestOptions{
-		Scopes: []string{"https://ossrdbms-aad.database.windows.net/.default"},
+		Scopes: scopes,
 	})
 	if err != nil {
 		return azcore.AccessToken{}, fmt.Errorf("getting token: %w", err)
@@ -40,6 +80,14 @@ func (c azureTokenConfig) fetchAzureAuthToken(ctx context.Context) (azcore.Acces
 	return token, nil
 }
 
+func (c azureTokenConfig) validate() error {
+	if err := validateAzureConfig(c.creds); err != nil {
+		return fmt.Errorf("invalid Azure config: %w", err)
+	}
+
+	return nil
+}
+
 func validateAzureConfig(creds azcore.TokenCredential) error {
 	if creds == nil {
 		return fmt.Errorf("azure credentials are required for Azure authentication")
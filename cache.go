@@ -0,0 +1,168 @@
+// Copyright IBM Corp. 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package pgmultiauth
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tokenCache holds the auth token shared by all connectors and pools created
+// from a Config, so that they don't each fetch and refresh their own token.
+// The Config of WithDirectAuthConnString connects elsewhere and has a cache
+// of its own, see directAuthConfig.
+type tokenCache struct {
+	// token is read without holding mu, mu serializes refreshes. Stored
+	// tokens are never modified, they are replaced by storing a new one.
+	token atomic.Pointer[authToken]
+	mu    sync.Mutex
+
+	// backgroundRefresh ensures a single background refresh per cache
+	backgroundRefresh sync.Once
+}
+
+// get returns the cached token, fetching a new one if none has been
+// fetched yet or the cached one is no longer valid. Copies of a Config
+// connecting elsewhere have caches of their own, see resetTokenCache.
+func (c *tokenCache) get(ctx context.Context, config Config) (*authToken, error) {
+	// no point in contending for lock if we know the token is valid
+	if current := c.token.Load(); current != nil && current.valid() {
+		return current, nil
+	}
+
+	token, refreshed, err := c.refresh(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	// outside of the lock, the callback may connect and get the token itself
+	if refreshed {
+		config.notifyTokenRefresh(token)
+	}
+
+	return token, nil
+}
+
+// refresh fetches a new token unless another caller has done so while waiting
+// for the lock. It reports whether the returned token was fetched.
+func (c *tokenCache) refresh(ctx context.Context, config Config) (*authToken, bool, error) {
+	// acquire lock if token is not valid
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// necessary because multiple connections might be waiting to acquire mu after finding the token invalid
+	// and the token might have been refreshed by a connection that acquired the lock first
+	current := c.token.Load()
+	if current != nil && current.valid() {
+		return current, false, nil
+	}
+
+	ctx = ensureRequestID(ctx)
+	if current == nil {
+		config.logger.Debug("getting initial db auth token", config.fetchLogFields(ctx)...)
+	} else {
+		config.logger.Debug("refreshing db token", config.fetchLogFields(ctx)...)
+	}
+
+	refreshed, err := getAuthTokenWithRetry(ctx, config)
+	if err != nil {
+		return nil, false, err
+	}
+
+	c.token.Store(refreshed)
+	return refreshed, true, nil
+}
+
+// invalidate marks the cached token invalid so that it is fetched again on
+// the next connect. It swaps the token instead of taking mu, which is held
+// while a token is fetched.
+func (c *tokenCache) invalidate() {
+	for {
+		current := c.token.Load()
+		if current == nil {
+			return
+		}
+
+		// keep the expiry, the background refresh still waits for it
+		invalidated := *current
+		invalidated.valid = func() bool { return false }
+		if c.token.CompareAndSwap(current, &invalidated) {
+			return
+		}
+	}
+}
+
+// InvalidateToken marks the cached auth tokens of the Config and its copies
+// invalid, so that the next connect fetches a new token instead of waiting
+// for the cached one to expire. This is useful when the database rejected a
+// token, e.g. after the credentials were revoked. Renewable Vault leases are
+// dropped as well, so that new credentials are read instead of renewing the
+// rejected ones. InvalidateToken does nothing for Configs not created by
+// NewConfig, which have no token cache.
+func (c Config) InvalidateToken() {
+	if c.tokens == nil {
+		return
+	}
+
+	c.tokens.invalidate()
+	if c.vaultLease != nil {
+		c.vaultLease.mu.Lock()
+		c.vaultLease.id = ""
+		c.vaultLease.mu.Unlock()
+	}
+
+	c.logger.Info("invalidated cached db auth tokens", c.logFields()...)
+}
+
+// TokenTimeToExpiry returns how long the cached auth token of the Config
+// remains valid, e.g. to export it as a gauge. It never fetches a token. It
+// reports false if no token has been fetched yet or the token doesn't expire,
+// and a negative duration once the token has expired without being refreshed.
+func (c Config) TokenTimeToExpiry() (time.Duration, bool) {
+	if c.tokens == nil {
+		return 0, false
+	}
+
+	token := c.tokens.token.Load()
+	if token == nil || token.expiresAt.IsZero() {
+		return 0, false
+	}
+
+	return token.expiresAt.Sub(c.now()()), true
+}
+
+// resetTokenCache gives the Config a token cache of its own. Options changing
+// how tokens are issued call it, so that a copy of a Config given other
+// credentials doesn't use the tokens of the original. Vault leases and logins
+// are dropped as well. Configs not created by NewConfig keep having no cache.
+func (c *Config) resetTokenCache() {
+	if c.tokens != nil {
+		c.tokens = &tokenCache{}
+	}
+
+	if c.directTokens != nil {
+		c.directTokens = &tokenCache{}
+	}
+
+	if c.vaultLease != nil {
+		c.vaultLease = &vaultLease{}
+	}
+
+	if a := c.vaultAppRole; a != nil {
+		c.vaultAppRole = &vaultAppRole{roleID: a.roleID, secretID: a.secretID, mount: a.mount}
+	}
+}
+
+// tokenCache returns the token cache shared by copies of the Config issuing
+// tokens the same way, see resetTokenCache. Configs not created by NewConfig
+// have none and get a new cache on every call.
+func (c Config) tokenCache() *tokenCache {
+	if c.tokens == nil {
+		return &tokenCache{}
+	}
+
+	return c.tokens
+}
@@ -0,0 +1,113 @@
+// Copyright IBM Corp. 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package pgmultiauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// errConfigClosed is returned when resources are requested from a closed Config.
+var errConfigClosed = errors.New("config is closed")
+
+// resources tracks the background goroutines and dialers started for a
+// Config. It is shared by copies of the Config so that Close releases the
+// resources of all of them.
+type resources struct {
+	mu      sync.Mutex
+	closed  bool
+	cancels []context.CancelFunc
+	closers []io.Closer
+
+	wg sync.WaitGroup
+}
+
+// run starts fn in a goroutine with a context that is cancelled when ctx is
+// done or the resources are closed. Configs not created by NewConfig have no
+// resources, fn then only stops when ctx is done.
+func (r *resources) run(ctx context.Context, fn func(context.Context)) {
+	if r == nil {
+		go fn(ctx)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	r.cancels = append(r.cancels, cancel)
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer cancel()
+		fn(ctx)
+	}()
+}
+
+// track registers closer to be closed along with the resources. It closes
+// closer right away and fails if the resources are already closed.
+func (r *resources) track(closer io.Closer) error {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		_ = closer.Close()
+		return errConfigClosed
+	}
+
+	r.closers = append(r.closers, closer)
+	return nil
+}
+
+// Close stops the background token refresh and closes the Cloud SQL and
+// AlloyDB dialers started for the Config and its copies. It should be called
+// at shutdown, once the databases and pools created from the Config are
+// closed, since their connections can no longer be authenticated afterwards.
+// Close waits for the background goroutines to exit. It is safe to call Close
+// more than once, calls after the first do nothing.
+func (c *Config) Close() error {
+	r := c.resources
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+
+	for _, cancel := range r.cancels {
+		cancel()
+	}
+
+	var errs []error
+	for _, closer := range r.closers {
+		if err := closer.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	r.mu.Unlock()
+
+	r.wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("closing dialers: %w", err)
+	}
+
+	return nil
+}
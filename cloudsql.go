@@ -0,0 +1,63 @@
+// Copyright IBM Corp. 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package pgmultiauth
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"cloud.google.com/go/cloudsqlconn"
+	"github.com/jackc/pgx/v5"
+)
+
+// cloudSQLDialer is the subset of *cloudsqlconn.Dialer used to connect
+// to Cloud SQL instances.
+type cloudSQLDialer interface {
+	Dial(ctx context.Context, icn string, opts ...cloudsqlconn.DialOption) (net.Conn, error)
+	Close() error
+}
+
+// newCloudSQLDialer creates the dialer used by the Cloud SQL connector.
+// It is a variable so that tests can avoid calling the Cloud SQL Admin API.
+var newCloudSQLDialer = func(ctx context.Context, opts ...cloudsqlconn.Option) (cloudSQLDialer, error) {
+	return cloudsqlconn.NewDialer(ctx, opts...)
+}
+
+// installCloudSQLDialer replaces the dial function of connConfig with one
+// connecting to the configured Cloud SQL instance. The dialer resolves the
+// instance address and handles TLS and IAM database authentication, so pgx
+// must neither resolve the host, negotiate TLS nor send a password.
+func (c Config) installCloudSQLDialer(ctx context.Context, connConfig *pgx.ConnConfig) error {
+	opts := append([]cloudsqlconn.Option{cloudsqlconn.WithIAMAuthN()}, c.cloudSQLOpts...)
+	dialer, err := newCloudSQLDialer(ctx, opts...)
+	if err != nil {
+		return fmt.Errorf("creating cloud sql dialer: %w", err)
+	}
+
+	if err := c.resources.track(dialer); err != nil {
+		return fmt.Errorf("creating cloud sql dialer: %w", err)
+	}
+
+	instance := c.cloudSQLInstance
+	connConfig.DialFunc = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dialer.Dial(ctx, instance)
+	}
+	connConfig.LookupFunc = func(_ context.Context, host string) ([]string, error) {
+		return []string{host}, nil
+	}
+	connConfig.TLSConfig = nil
+	connConfig.Fallbacks = nil
+	connConfig.Password = ""
+
+	return nil
+}
+
+func validateCloudSQLConfig(instanceConnectionName string) error {
+	if instanceConnectionName == "" {
+		return fmt.Errorf("instance connection name is required for the Cloud SQL connector")
+	}
+
+	return nil
+}
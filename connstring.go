@@ -0,0 +1,324 @@
+// Copyright IBM Corp. 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package pgmultiauth
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// ConnStringFormat is the format of a PostgreSQL connection string.
+type ConnStringFormat int
+
+const (
+	// FormatURL is a connection URL, e.g. "postgres://user@host:5432/db"
+	FormatURL ConnStringFormat = iota
+	// FormatDSN is a DSN of key=value settings, e.g. "host=host user=user"
+	FormatDSN
+)
+
+// GetAuthenticatedConnStringAs returns the connection string of
+// GetAuthenticatedConnString in the given format, converting it if the
+// configured connection string has the other format. Values are escaped as
+// needed by the format, e.g. a token containing "@" or whitespace.
+func GetAuthenticatedConnStringAs(ctx context.Context, config Config, format ConnStringFormat) (string, error) {
+	if format != FormatURL && format != FormatDSN {
+		return "", fmt.Errorf("unknown connection string format %d", format)
+	}
+
+	connString, err := GetAuthenticatedConnString(ctx, config)
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case format == FormatDSN && isConnURL(connString):
+		connString, err = connURLToDSN(connString)
+	case format == FormatURL && !isConnURL(connString):
+		connString, err = dsnToConnURL(connString)
+	}
+	if err != nil {
+		return "", fmt.Errorf("converting connection string: %w", err)
+	}
+
+	return connString, nil
+}
+
+// connURLToDSN converts a connection URL to a DSN. Query parameters become
+// settings in alphabetical order after the user, password, hosts, ports and
+// database name.
+func connURLToDSN(connURL string) (string, error) {
+	u, err := url.Parse(connURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse connection URL: %w", err)
+	}
+
+	var settings []string
+	add := func(key, value string) {
+		settings = append(settings, key+"="+quoteDSNValue(value))
+	}
+
+	if u.User != nil {
+		add("user", u.User.Username())
+		if password, ok := u.User.Password(); ok {
+			add("password", password)
+		}
+	}
+
+	if u.Host != "" {
+		var hosts, ports []string
+		hasPort := false
+		for _, hostPort := range strings.Split(u.Host, ",") {
+			host, port := hostPort, "5432"
+			if h, p, err := net.SplitHostPort(hostPort); err == nil {
+				host, port, hasPort = h, p, true
+			} else {
+				// IPv6 addresses without a port are bracketed as well
+				host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+			}
+
+			hosts = append(hosts, host)
+			ports = append(ports, port)
+		}
+
+		add("host", strings.Join(hosts, ","))
+		if hasPort {
+			add("port", strings.Join(ports, ","))
+		}
+	}
+
+	if dbname := strings.TrimPrefix(u.Path, "/"); dbname != "" {
+		add("dbname", dbname)
+	}
+
+	query := u.Query()
+	for _, key := range slices.Sorted(maps.Keys(query)) {
+		add(key, query.Get(key))
+	}
+
+	return strings.Join(settings, " "), nil
+}
+
+// dsnToConnURL converts a DSN to a connection URL. Settings other than the
+// user, password, hosts, ports and database name become query parameters, as
+// do Unix domain socket hosts, which can't be the host of a URL.
+func dsnToConnURL(dsn string) (string, error) {
+	u := &url.URL{Scheme: "postgres"}
+	query := url.Values{}
+
+	var user, password, hosts, ports string
+	var hasUser, hasPassword bool
+	for _, setting := range splitDSN(dsn) {
+		value, ok := setting.value()
+		if !ok {
+			return "", fmt.Errorf("invalid DSN setting %q, missing value", setting.raw)
+		}
+
+		switch setting.key {
+		case "user":
+			user, hasUser = value, true
+		case "password":
+			password, hasPassword = value, true
+		case "host":
+			hosts = value
+		case "port":
+			ports = value
+		case "dbname":
+			u.Path = "/" + value
+		default:
+			query.Set(setting.key, value)
+		}
+	}
+
+	switch {
+	case hasPassword:
+		u.User = url.UserPassword(user, password)
+	case hasUser:
+		u.User = url.User(user)
+	}
+
+	if isUnixSocketHost(hosts) {
+		query.Set("host", hosts)
+		if ports != "" {
+			query.Set("port", ports)
+		}
+	} else if hosts != "" {
+		hostList, portList := strings.Split(hosts, ","), strings.Split(ports, ",")
+		hostPorts := make([]string, len(hostList))
+		for i, host := range hostList {
+			// a single port applies to all hosts
+			port := portList[0]
+			if len(portList) == len(hostList) {
+				port = portList[i]
+			}
+
+			if port == "" {
+				if strings.Contains(host, ":") {
+					host = "[" + host + "]"
+				}
+				hostPorts[i] = host
+			} else {
+				hostPorts[i] = net.JoinHostPort(host, port)
+			}
+		}
+
+		u.Host = strings.Join(hostPorts, ",")
+	} else if ports != "" {
+		query.Set("port", ports)
+	}
+
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// value returns the unquoted and unescaped value of the setting. It reports
+// false if the setting has no value.
+func (s dsnSetting) value() (string, bool) {
+	_, raw, ok := strings.Cut(s.raw, "=")
+	if !ok {
+		return "", false
+	}
+
+	raw = strings.TrimLeft(raw, " \t\n\r\v\f")
+	quoted := strings.HasPrefix(raw, "'")
+	if quoted {
+		raw = strings.TrimSuffix(raw[1:], "'")
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(raw); i++ {
+		if raw[i] == '\\' && i+1 < len(raw) {
+			i++
+		}
+		b.WriteByte(raw[i])
+	}
+
+	return b.String(), true
+}
+
+// urlSchemePattern matches the scheme of a URL, e.g. "postgres://".
+var urlSchemePattern = regexp.MustCompile(`^([a-zA-Z][a-zA-Z0-9+.-]*)://`)
+
+// isConnURL checks if connString is a connection URL rather than a DSN
+// (key=value format).
+func isConnURL(connString string) bool {
+	return strings.HasPrefix(connString, "postgres://") || strings.HasPrefix(connString, "postgresql://")
+}
+
+// hasConnStringUser checks if the connection string of the Config sets a
+// user, as opposed to pgx defaulting to the user of the process. The user of
+// a Config created from a pgx.ConnConfig is taken as set.
+func (c Config) hasConnStringUser() bool {
+	if c.connConfig != nil {
+		return c.connConfig.User != ""
+	}
+
+	u := c.connURL
+	if u == nil && isConnURL(c.connString) {
+		var err error
+		if u, err = url.Parse(c.connString); err != nil {
+			return false
+		}
+	}
+
+	if u != nil {
+		return u.User.Username() != "" || u.Query().Get("user") != ""
+	}
+
+	for _, setting := range splitDSN(c.connString) {
+		if value, ok := setting.value(); ok && setting.key == "user" && value != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// normalizeConnString removes surrounding whitespace from connString, e.g.
+// the trailing newline of a file it was read from, and lowercases the scheme
+// of connection URLs, which pgx only recognizes in lowercase.
+func normalizeConnString(connString string) string {
+	connString = strings.TrimSpace(connString)
+
+	if m := urlSchemePattern.FindStringSubmatch(connString); m != nil {
+		scheme := strings.ToLower(m[1])
+		if scheme == "postgres" || scheme == "postgresql" {
+			connString = scheme + connString[len(m[1]):]
+		}
+	}
+
+	return connString
+}
+
+// validateConnString checks that connString is a connection URL or a DSN with
+// at least one key=value setting, so that typos like "postgre://" are
+// reported instead of being treated as a DSN.
+func validateConnString(connString string) error {
+	if strings.TrimSpace(connString) == "" {
+		return fmt.Errorf("connString cannot be empty")
+	}
+
+	if m := urlSchemePattern.FindStringSubmatch(connString); m != nil {
+		if !isConnURL(connString) {
+			return fmt.Errorf("unsupported connection URL scheme %q, use postgres:// or postgresql://", m[1])
+		}
+
+		return nil
+	}
+
+	for _, setting := range splitDSN(connString) {
+		if setting.raw != setting.key {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("connection string is neither a postgres:// URL nor a DSN of key=value settings")
+}
+
+// withoutQueryParam removes the key parameters from the raw query of a
+// connection URL. The other parameters are kept verbatim and in order, as
+// re-encoding the query would change security settings like channel_binding
+// or sslmode that are passed on to the server as written.
+func withoutQueryParam(rawQuery, key string) string {
+	if rawQuery == "" {
+		return rawQuery
+	}
+
+	params := strings.Split(rawQuery, "&")
+	kept := params[:0]
+	for _, param := range params {
+		name, _, _ := strings.Cut(param, "=")
+		if unescaped, err := url.QueryUnescape(name); err == nil && unescaped == key {
+			continue
+		}
+		kept = append(kept, param)
+	}
+
+	return strings.Join(kept, "&")
+}
+
+// redactQueryParam replaces the values of the key parameters in the raw query
+// of a connection URL. Like in withoutQueryParam, the other parameters are
+// kept verbatim and in order.
+func redactQueryParam(rawQuery, key string) string {
+	if rawQuery == "" {
+		return rawQuery
+	}
+
+	params := strings.Split(rawQuery, "&")
+	for i, param := range params {
+		name, _, _ := strings.Cut(param, "=")
+		if unescaped, err := url.QueryUnescape(name); err == nil && unescaped == key {
+			params[i] = name + "=" + redactedPassword
+		}
+	}
+
+	return strings.Join(params, "&")
+}
@@ -0,0 +1,70 @@
+// Copyright IBM Corp. 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package pgmultiauth
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+type customTokenConfig struct {
+	generate func(ctx context.Context) (string, time.Time, error)
+
+	refreshBuffer time.Duration
+	clock         func() time.Time
+}
+
+func (c customTokenConfig) generateToken(ctx context.Context) (*authToken, error) {
+	token, expiry, err := c.generate(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("generating custom token: %w", err)
+	}
+
+	// Tokens without an expiry never expire
+	validFn := func() bool { return true }
+	if !expiry.IsZero() {
+		// Consider the token expired refreshBuffer before actual expiry to account for network latency
+		validFn = validBefore(c.clock, expiry, c.refreshBuffer)
+	}
+
+	return &authToken{token: token, valid: validFn, expiresAt: expiry}, nil
+}
+
+type overrideTokenConfig struct {
+	gen TokenGenerator
+
+	refreshBuffer time.Duration
+	clock         func() time.Time
+}
+
+func (c overrideTokenConfig) generateToken(ctx context.Context) (*authToken, error) {
+	token, err := c.gen.GenerateToken(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("generating token with override: %w", err)
+	}
+
+	validFn := func() bool { return true }
+	if !token.ExpiresAt.IsZero() {
+		validFn = validBefore(c.clock, token.ExpiresAt, c.refreshBuffer)
+	}
+
+	return &authToken{token: token.Value, username: token.Username, valid: validFn, expiresAt: token.ExpiresAt}, nil
+}
+
+func (c customTokenConfig) validate() error {
+	if err := validateCustomConfig(c.generate); err != nil {
+		return fmt.Errorf("invalid custom auth config: %w", err)
+	}
+
+	return nil
+}
+
+func validateCustomConfig(generate func(ctx context.Context) (string, time.Time, error)) error {
+	if generate == nil {
+		return fmt.Errorf("token generator is required for custom authentication")
+	}
+
+	return nil
+}
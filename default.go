@@ -6,76 +6,521 @@ package pgmultiauth
 import (
 	"context"
 	"fmt"
+	"runtime/debug"
+	"strings"
+	"sync"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/jackc/pgx/v5/pgconn"
 	"golang.org/x/oauth2/google"
 )
 
+// AzureCredentialKind selects the Azure credential DefaultConfig uses.
+type AzureCredentialKind int
+
+const (
+	// AzureMSI uses Managed Identity, preceded by Workload Identity when it
+	// is configured in the environment. This is the default.
+	AzureMSI AzureCredentialKind = iota
+	// AzureCLI uses the account signed in with the Azure CLI, e.g. for local development.
+	AzureCLI
+	// AzureEnvironment uses a service principal configured through the
+	// AZURE_TENANT_ID, AZURE_CLIENT_ID and AZURE_CLIENT_SECRET (or certificate)
+	// environment variables.
+	AzureEnvironment
+	// AzureDefaultChain uses azidentity.DefaultAzureCredential, which tries
+	// environment, workload identity, managed identity and developer credentials.
+	AzureDefaultChain
+)
+
+// AzureCloud selects the Azure cloud DefaultConfig authenticates against.
+type AzureCloud int
+
+const (
+	// AzurePublicCloud is the global Azure cloud. This is the default.
+	AzurePublicCloud AzureCloud = iota
+	// AzureUSGovernmentCloud is Azure Government.
+	AzureUSGovernmentCloud
+	// AzureChinaCloud is Azure operated by 21Vianet.
+	AzureChinaCloud
+)
+
+// configuration returns the authority of the cloud for azidentity credentials.
+func (c AzureCloud) configuration() (cloud.Configuration, error) {
+	switch c {
+	case AzurePublicCloud:
+		return cloud.AzurePublic, nil
+	case AzureUSGovernmentCloud:
+		return cloud.AzureGovernment, nil
+	case AzureChinaCloud:
+		return cloud.AzureChina, nil
+	default:
+		return cloud.Configuration{}, fmt.Errorf("unsupported Azure cloud: %d", c)
+	}
+}
+
+// scope returns the token scope of Azure Database for PostgreSQL in the cloud.
+func (c AzureCloud) scope() string {
+	switch c {
+	case AzureUSGovernmentCloud:
+		return "https://ossrdbms-aad.database.usgovcloudapi.net/.default"
+	case AzureChinaCloud:
+		return "https://ossrdbms-aad.database.chinacloudapi.cn/.default"
+	default:
+		return defaultAzureScope
+	}
+}
+
 // DefaultAuthConfigOptions holds the configuration options for various authentication
 // methods.
 type DefaultAuthConfigOptions struct {
 	AuthMethod AuthMethod
 
 	// AWS IAM Auth
+	// Region of the database, derived from the host of the connection
+	// string when empty and the host is an RDS endpoint
 	AWSDBRegion string
+	// Optional database user for AWS IAM Auth, defaults to the user
+	// of the connection string
+	AWSDBUser string
+
+	// Optional role to assume for AWS IAM Auth, e.g. when the database
+	// lives in a different AWS account than the application
+	AWSAssumeRoleARN string
+	// Optional external ID used when assuming AWSAssumeRoleARN, requires it
+	AWSExternalID string
+
+	// Optional profile of the shared AWS config and credentials files, e.g. an
+	// SSO profile for local development. The default profile, or the one set
+	// by AWS_PROFILE, is used when empty. The region of the profile is used
+	// if AWSDBRegion is empty and the host isn't an RDS endpoint.
+	AWSProfile string
+
+	// Get AWS credentials only from the EC2 instance metadata service (IMDS)
+	// instead of the default chain, which prefers environment variables and
+	// shared credentials files, e.g. when those hold stale credentials
+	AWSForceIMDS bool
+
+	// Optional path to a JSON key file for GCP Auth, e.g. a service account
+	// key. Application Default Credentials are used when empty.
+	GCPCredentialsFile string
+
+	// Optional service account to impersonate for GCP Auth. The default
+	// credentials must be allowed to create tokens for this service account.
+	GCPImpersonateServiceAccount string
 
-	// ClientID for Azure MSI Auth
+	// Optional OAuth scopes of the GCP credentials, e.g.
+	// "https://www.googleapis.com/auth/sqlservice.login" where the broad
+	// cloud-platform scope is not allowed. Defaults to cloud-platform.
+	GCPScopes []string
+
+	// ClientID for Azure MSI Auth, not supported with the other
+	// AzureCredentialKinds
 	AzureClientID string
+
+	// Optional kind of Azure credential, defaults to AzureMSI
+	AzureCredentialKind AzureCredentialKind
+
+	// Optional sovereign cloud for Azure, defaults to AzurePublicCloud. It
+	// selects the authority of the credentials and the default token scope.
+	AzureCloud AzureCloud
+
+	// Use only Azure Workload Identity instead of trying Workload Identity
+	// and then Managed Identity. AzureClientID, AzureTenantID and
+	// AzureFederatedTokenFile default to the AZURE_CLIENT_ID, AZURE_TENANT_ID
+	// and AZURE_FEDERATED_TOKEN_FILE environment variables when empty. The
+	// token file requires AzureUseWorkloadIdentity, and so does the tenant ID
+	// unless AzureCLI or AzureDefaultChain is selected.
+	AzureUseWorkloadIdentity bool
+	AzureTenantID            string
+	AzureFederatedTokenFile  string
+
+	// Defer creating the credentials until the first token is fetched instead
+	// of creating them in DefaultConfig, which may call metadata endpoints
+	Lazy bool
 }
 
 // DefaultConfig initializes Config with default behavior across the auth methods.
 // For Cloud based auth it assumes that application is running in the cloud environment.
-// For AWS, it uses AWS IAM authentication
-// For GCP, it uses GCP default credentials
-// For Azure, it uses Workload Identity or Managed Identity (MSI) authentication
+// For AWS, it uses AWS IAM authentication, optionally assuming a role
+// For GCP, it uses GCP default credentials or GCPCredentialsFile, optionally impersonating a service account
+// For Azure, it uses Workload Identity or Managed Identity (MSI) authentication,
+// or only Workload Identity if AzureUseWorkloadIdentity is set, unless another
+// AzureCredentialKind is selected
 // For StandardAuth, it uses the default PostgreSQL authentication
+// If authOpts.Lazy is set, the credentials are created when the first token is
+// fetched and errors creating them are returned from there.
 func DefaultConfig(ctx context.Context, connString string, authOpts DefaultAuthConfigOptions, opts ...ConfigOpt) (Config, error) {
-	if authOpts.AuthMethod == AWSAuth {
-		if authOpts.AWSDBRegion == "" {
+	if err := authOpts.validate(); err != nil {
+		return Config{}, &ConfigValidationError{Err: err}
+	}
+
+	if authOpts.AuthMethod == AWSAuth && authOpts.AWSDBRegion == "" {
+		// RDS endpoints contain their region
+		// and so may the AWS profile
+		region, ok := regionFromConnString(connString)
+		if !ok && authOpts.AWSProfile == "" {
 			return Config{}, fmt.Errorf("AWSDBRegion is required for AWS IAM authentication")
 		}
+		authOpts.AWSDBRegion = region
+	}
+
+	// the auth options are applied after opts, which may set the user agent
+	// of the clients they create
+	cfg := NewConfig(connString, opts...)
+	userAgent := cfg.sdkUserAgent()
+
+	if authOpts.Lazy && authOpts.AuthMethod != StandardAuth {
+		withLazyCredentials(authOpts.AuthMethod, func(ctx context.Context) ([]ConfigOpt, error) {
+			return defaultAuthConfigOpts(ctx, authOpts, userAgent)
+		})(&cfg)
+
+		return cfg, nil
+	}
+
+	authConfigOpts, err := defaultAuthConfigOpts(ctx, authOpts, userAgent)
+	if err != nil {
+		return Config{}, err
+	}
+	for _, opt := range authConfigOpts {
+		opt(&cfg)
+	}
+
+	return cfg, nil
+}
+
+// validate checks that only options of the selected auth method are set,
+// so that misconfigurations don't go unnoticed.
+func (o DefaultAuthConfigOptions) validate() error {
+	methodOpts := []struct {
+		method AuthMethod
+		name   string
+		set    bool
+	}{
+		{AWSAuth, "AWSDBRegion", o.AWSDBRegion != ""},
+		{AWSAuth, "AWSDBUser", o.AWSDBUser != ""},
+		{AWSAuth, "AWSAssumeRoleARN", o.AWSAssumeRoleARN != ""},
+		{AWSAuth, "AWSExternalID", o.AWSExternalID != ""},
+		{AWSAuth, "AWSProfile", o.AWSProfile != ""},
+		{AWSAuth, "AWSForceIMDS", o.AWSForceIMDS},
+		{GCPAuth, "GCPCredentialsFile", o.GCPCredentialsFile != ""},
+		{GCPAuth, "GCPImpersonateServiceAccount", o.GCPImpersonateServiceAccount != ""},
+		{GCPAuth, "GCPScopes", len(o.GCPScopes) > 0},
+		{AzureAuth, "AzureClientID", o.AzureClientID != ""},
+		{AzureAuth, "AzureCredentialKind", o.AzureCredentialKind != AzureMSI},
+		{AzureAuth, "AzureCloud", o.AzureCloud != AzurePublicCloud},
+		{AzureAuth, "AzureUseWorkloadIdentity", o.AzureUseWorkloadIdentity},
+		{AzureAuth, "AzureTenantID", o.AzureTenantID != ""},
+		{AzureAuth, "AzureFederatedTokenFile", o.AzureFederatedTokenFile != ""},
+	}
+
+	var unsupported []string
+	for _, opt := range methodOpts {
+		if opt.set && opt.method != o.AuthMethod {
+			unsupported = append(unsupported, opt.name)
+		}
+	}
+
+	if len(unsupported) > 0 {
+		return fmt.Errorf("%s not supported with auth method %s", strings.Join(unsupported, ", "), o.AuthMethod)
+	}
+
+	if o.AuthMethod == AzureAuth {
+		if err := o.validateAzureKind(); err != nil {
+			return err
+		}
+	}
+
+	// the external ID is only sent when assuming a role
+	if o.AWSExternalID != "" && o.AWSAssumeRoleARN == "" {
+		return fmt.Errorf("AWSExternalID requires AWSAssumeRoleARN")
+	}
+
+	return nil
+}
+
+// validateAzureKind checks that only Azure options used by the selected
+// AzureCredentialKind are set. The client ID selects the managed identity of
+// AzureMSI, the tenant ID and token file configure its Workload Identity, and
+// AzureCLI and AzureDefaultChain take a tenant ID as well.
+func (o DefaultAuthConfigOptions) validateAzureKind() error {
+	kinds := map[AzureCredentialKind]string{
+		AzureMSI:          "AzureMSI",
+		AzureCLI:          "AzureCLI",
+		AzureEnvironment:  "AzureEnvironment",
+		AzureDefaultChain: "AzureDefaultChain",
+	}
+	kind, ok := kinds[o.AzureCredentialKind]
+	if !ok {
+		// newAzureCredential rejects the kind
+		return nil
+	}
+
+	msi := o.AzureCredentialKind == AzureMSI
+	workloadIdentity := msi && o.AzureUseWorkloadIdentity
+	if msi && !workloadIdentity {
+		kind = "AzureMSI without AzureUseWorkloadIdentity"
+	}
+
+	kindOpts := []struct {
+		name      string
+		set       bool
+		supported bool
+	}{
+		{"AzureClientID", o.AzureClientID != "", msi},
+		{"AzureUseWorkloadIdentity", o.AzureUseWorkloadIdentity, msi},
+		{"AzureTenantID", o.AzureTenantID != "", workloadIdentity || o.AzureCredentialKind == AzureCLI || o.AzureCredentialKind == AzureDefaultChain},
+		{"AzureFederatedTokenFile", o.AzureFederatedTokenFile != "", workloadIdentity},
+	}
+
+	var unsupported []string
+	for _, opt := range kindOpts {
+		if opt.set && !opt.supported {
+			unsupported = append(unsupported, opt.name)
+		}
+	}
+
+	if len(unsupported) > 0 {
+		return fmt.Errorf("%s not supported with AzureCredentialKind %s", strings.Join(unsupported, ", "), kind)
+	}
+
+	return nil
+}
+
+// gcpScopes returns the OAuth scopes requested for GCP credentials.
+func (o DefaultAuthConfigOptions) gcpScopes() []string {
+	if len(o.GCPScopes) == 0 {
+		return []string{defaultGCPScope}
+	}
 
-		cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(authOpts.AWSDBRegion))
+	return o.GCPScopes
+}
+
+// sdkUserAgent returns the user agent set by WithUserAgent, or the default
+// user agent.
+func (c Config) sdkUserAgent() string {
+	if c.userAgent == "" {
+		return defaultUserAgent()
+	}
+
+	return c.userAgent
+}
+
+// defaultUserAgent returns "go-pgmultiauth/<version>", with the version of
+// the module the binary was built with if it is known.
+func defaultUserAgent() string {
+	const name = "go-pgmultiauth"
+	const modulePath = "github.com/hashicorp/" + name
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return name
+	}
+
+	for _, dep := range append([]*debug.Module{&info.Main}, info.Deps...) {
+		if dep.Path == modulePath && dep.Version != "" && dep.Version != "(devel)" {
+			return name + "/" + dep.Version
+		}
+	}
+
+	return name
+}
+
+// regionFromConnString returns the AWS region of the RDS endpoint the
+// connection string connects to, see regionFromRDSHost.
+func regionFromConnString(connString string) (string, bool) {
+	connConfig, err := pgconn.ParseConfig(connString)
+	if err != nil {
+		return "", false
+	}
+
+	return regionFromRDSHost(connConfig.Host)
+}
+
+// defaultAuthConfigOpts creates the credentials selected by authOpts and
+// returns the options configuring them.
+func defaultAuthConfigOpts(ctx context.Context, authOpts DefaultAuthConfigOptions, userAgent string) ([]ConfigOpt, error) {
+	var opts []ConfigOpt
+
+	if authOpts.AuthMethod == AWSAuth {
+		loadOpts := []func(*config.LoadOptions) error{config.WithRegion(authOpts.AWSDBRegion), config.WithAppID(userAgent)}
+		if authOpts.AWSProfile != "" {
+			loadOpts = append(loadOpts, config.WithSharedConfigProfile(authOpts.AWSProfile))
+		}
+
+		cfg, err := config.LoadDefaultConfig(ctx, loadOpts...)
 		if err != nil {
-			return Config{}, fmt.Errorf("failed to load AWS config: %v", err)
+			return nil, fmt.Errorf("failed to load AWS config: %w", err)
+		}
+
+		if cfg.Region == "" {
+			return nil, fmt.Errorf("AWSDBRegion is required for AWS IAM authentication, AWS profile %q has no region", authOpts.AWSProfile)
+		}
+
+		if authOpts.AWSForceIMDS {
+			cfg.Credentials = aws.NewCredentialsCache(ec2rolecreds.New(func(o *ec2rolecreds.Options) {
+				o.Client = imds.NewFromConfig(cfg)
+			}))
+		}
+
+		if authOpts.AWSAssumeRoleARN != "" {
+			cfg = assumeAWSRole(cfg, sts.NewFromConfig(cfg), authOpts.AWSAssumeRoleARN, authOpts.AWSExternalID)
 		}
 
 		opts = append(opts, WithAWSAuth(&cfg))
+		if authOpts.AWSDBUser != "" {
+			opts = append(opts, WithAWSUser(authOpts.AWSDBUser))
+		}
 	} else if authOpts.AuthMethod == GCPAuth {
-		creds, err := google.FindDefaultCredentials(ctx, "https://www.googleapis.com/auth/cloud-platform")
+		var creds *google.Credentials
+		var err error
+		if authOpts.GCPCredentialsFile != "" {
+			creds, err = gcpCredentialsFromFile(ctx, authOpts.GCPCredentialsFile, authOpts.gcpScopes())
+		} else {
+			creds, err = findGCPDefaultCredentials(ctx, authOpts.gcpScopes()...)
+		}
 		if err != nil {
-			return Config{}, fmt.Errorf("failed to get GCP credentials: %v", err)
+			return nil, fmt.Errorf("failed to get GCP credentials: %w", err)
+		}
+
+		if authOpts.GCPImpersonateServiceAccount != "" {
+			creds, err = impersonateGCPServiceAccount(ctx, creds, authOpts.GCPImpersonateServiceAccount, userAgent, authOpts.gcpScopes())
+			if err != nil {
+				return nil, fmt.Errorf("failed to impersonate GCP service account: %w", err)
+			}
 		}
 
 		opts = append(opts, WithGoogleAuth(creds))
 	} else if authOpts.AuthMethod == AzureAuth {
-		// Use a credential chain to support Workload Identity and Managed Identity.
-		var sources []azcore.TokenCredential
-
-		// 1. Workload Identity
-		if wiCred, err := azidentity.NewWorkloadIdentityCredential(nil); err == nil {
-			sources = append(sources, wiCred)
+		creds, err := newAzureCredential(authOpts, userAgent)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Azure credential: %w", err)
 		}
 
-		// 2. Managed Identity
-		msiCredOpts := &azidentity.ManagedIdentityCredentialOptions{}
-		if authOpts.AzureClientID != "" {
-			msiCredOpts.ID = azidentity.ClientID(authOpts.AzureClientID)
-		}
-		if msiCred, err := azidentity.NewManagedIdentityCredential(msiCredOpts); err == nil {
-			sources = append(sources, msiCred)
-		}
+		opts = append(opts, WithAzureAuth(creds), withAzureCloud(authOpts.AzureCloud))
+	}
+
+	return opts, nil
+}
+
+// lazyCredentials loads the credentials of a Config when the first token
+// is fetched. Loading is retried on the next fetch if it fails.
+type lazyCredentials struct {
+	mu   sync.Mutex
+	load func(ctx context.Context) ([]ConfigOpt, error)
+	// opts configure the loaded credentials, nil until they are loaded
+	opts []ConfigOpt
+}
+
+// withLazyCredentials sets the authentication method of the Config and
+// defers configuring its credentials to the first token fetch.
+func withLazyCredentials(method AuthMethod, load func(ctx context.Context) ([]ConfigOpt, error)) ConfigOpt {
+	return func(c *Config) {
+		c.authMethod = method
+		c.lazyCreds = &lazyCredentials{load: load}
+	}
+}
 
-		creds, err := azidentity.NewChainedTokenCredential(sources, nil)
+// resolve returns a copy of config with the credentials loaded.
+func (l *lazyCredentials) resolve(ctx context.Context, config Config) (Config, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.opts == nil {
+		opts, err := l.load(ctx)
 		if err != nil {
-			return Config{}, fmt.Errorf("failed to create Azure credential: %v", err)
+			return Config{}, err
 		}
+		l.opts = opts
+	}
 
-		opts = append(opts, WithAzureAuth(creds))
+	for _, opt := range l.opts {
+		opt(&config)
 	}
-	cfg := NewConfig(connString, opts...)
+	config.lazyCreds = nil
 
-	return cfg, nil
+	if err := config.validate(); err != nil {
+		return Config{}, err
+	}
+
+	return config, nil
+}
+
+// newAzureCredential creates the Azure credential selected by authOpts.
+func newAzureCredential(authOpts DefaultAuthConfigOptions, userAgent string) (azcore.TokenCredential, error) {
+	cloudConfig, err := authOpts.AzureCloud.configuration()
+	if err != nil {
+		return nil, err
+	}
+	clientOpts := azureClientOptions(userAgent, cloudConfig)
+
+	switch authOpts.AzureCredentialKind {
+	case AzureMSI:
+		// Handled below
+	case AzureCLI:
+		// The Azure CLI credential runs the az command instead of sending requests
+		return azidentity.NewAzureCLICredential(&azidentity.AzureCLICredentialOptions{
+			TenantID: authOpts.AzureTenantID,
+		})
+	case AzureEnvironment:
+		return azidentity.NewEnvironmentCredential(&azidentity.EnvironmentCredentialOptions{
+			ClientOptions: clientOpts,
+		})
+	case AzureDefaultChain:
+		return azidentity.NewDefaultAzureCredential(&azidentity.DefaultAzureCredentialOptions{
+			ClientOptions: clientOpts,
+			TenantID:      authOpts.AzureTenantID,
+		})
+	default:
+		return nil, fmt.Errorf("unsupported Azure credential kind: %d", authOpts.AzureCredentialKind)
+	}
+
+	if authOpts.AzureUseWorkloadIdentity {
+		return azidentity.NewWorkloadIdentityCredential(&azidentity.WorkloadIdentityCredentialOptions{
+			ClientOptions: clientOpts,
+			ClientID:      authOpts.AzureClientID,
+			TenantID:      authOpts.AzureTenantID,
+			TokenFilePath: authOpts.AzureFederatedTokenFile,
+		})
+	}
+
+	// Use a credential chain to support Workload Identity and Managed Identity.
+	var sources []azcore.TokenCredential
+
+	// 1. Workload Identity
+	if wiCred, err := azidentity.NewWorkloadIdentityCredential(&azidentity.WorkloadIdentityCredentialOptions{ClientOptions: clientOpts}); err == nil {
+		sources = append(sources, wiCred)
+	}
+
+	// 2. Managed Identity
+	msiCredOpts := &azidentity.ManagedIdentityCredentialOptions{ClientOptions: clientOpts}
+	if authOpts.AzureClientID != "" {
+		msiCredOpts.ID = azidentity.ClientID(authOpts.AzureClientID)
+	}
+	if msiCred, err := newAzureManagedIdentityCredential(msiCredOpts); err == nil {
+		sources = append(sources, msiCred)
+	}
+
+	return azidentity.NewChainedTokenCredential(sources, nil)
+}
+
+// newAzureManagedIdentityCredential creates the Managed Identity credential
+// of the AzureMSI kind. It is a variable so that tests can inspect its options.
+var newAzureManagedIdentityCredential = azidentity.NewManagedIdentityCredential
+
+// azureClientOptions returns the client options of Azure credentials
+// identifying requests with userAgent and authenticating against cloudConfig.
+func azureClientOptions(userAgent string, cloudConfig cloud.Configuration) azcore.ClientOptions {
+	return azcore.ClientOptions{
+		Cloud:     cloudConfig,
+		Telemetry: policy.TelemetryOptions{ApplicationID: userAgent},
+	}
 }
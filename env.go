@@ -0,0 +1,153 @@
+// Copyright IBM Corp. 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package pgmultiauth
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// azureCredentialKinds maps the values of AZURE_CREDENTIAL_KIND to the kinds
+// of Azure credentials.
+var azureCredentialKinds = map[string]AzureCredentialKind{
+	"msi":         AzureMSI,
+	"cli":         AzureCLI,
+	"environment": AzureEnvironment,
+	"default":     AzureDefaultChain,
+}
+
+// azureClouds maps the values of AZURE_CLOUD to the Azure clouds.
+var azureClouds = map[string]AzureCloud{
+	"public":       AzurePublicCloud,
+	"usgovernment": AzureUSGovernmentCloud,
+	"china":        AzureChinaCloud,
+}
+
+// DefaultConfigFromEnv creates a Config with DefaultConfig from the
+// following environment variables:
+//
+//   - DATABASE_URL: the connection string, required
+//   - AUTH_METHOD: the auth method, e.g. "aws", see ParseAuthMethod. Defaults
+//     to "standard". DefaultConfig only supports standard, aws, gcp and azure.
+//
+// For AWS:
+//
+//   - AWS_REGION: the region of the database, derived from the host of
+//     DATABASE_URL when unset and the host is an RDS endpoint
+//   - AWS_DB_USER: the database user, defaults to the user of DATABASE_URL
+//   - AWS_ASSUME_ROLE_ARN and AWS_EXTERNAL_ID: the role to assume
+//   - AWS_PROFILE: the profile of the shared AWS config files
+//   - AWS_FORCE_IMDS: "true" to only get credentials from the EC2 instance
+//     metadata service
+//
+// For GCP, credentials are found as Application Default Credentials, e.g.
+// through GOOGLE_APPLICATION_CREDENTIALS, unless GCP_CREDENTIALS_FILE is set:
+//
+//   - GCP_CREDENTIALS_FILE: the path to a JSON key file
+//   - GCP_IMPERSONATE_SERVICE_ACCOUNT: the service account to impersonate
+//   - GCP_SCOPES: the comma-separated OAuth scopes of the credentials
+//
+// For Azure:
+//
+//   - AZURE_CLIENT_ID: the client ID of the managed identity of the msi kind
+//   - AZURE_CREDENTIAL_KIND: one of "msi" (default), "cli", "environment"
+//     and "default", see AzureCredentialKind
+//   - AZURE_CLOUD: one of "public" (default), "usgovernment" and "china"
+//   - AZURE_USE_WORKLOAD_IDENTITY: "true" to only use Workload Identity,
+//     configured through AZURE_TENANT_ID and AZURE_FEDERATED_TOKEN_FILE
+//
+// Variables of other auth methods than AUTH_METHOD are ignored. Errors for
+// missing or invalid variables match ErrInvalidConfig.
+func DefaultConfigFromEnv(ctx context.Context, opts ...ConfigOpt) (Config, error) {
+	connString, authOpts, err := defaultAuthConfigOptsFromEnv()
+	if err != nil {
+		return Config{}, &ConfigValidationError{Err: err}
+	}
+
+	return DefaultConfig(ctx, connString, authOpts, opts...)
+}
+
+// defaultAuthConfigOptsFromEnv reads the connection string and the options of
+// DefaultConfig from the environment, see DefaultConfigFromEnv.
+func defaultAuthConfigOptsFromEnv() (string, DefaultAuthConfigOptions, error) {
+	var authOpts DefaultAuthConfigOptions
+
+	connString := os.Getenv("DATABASE_URL")
+	if connString == "" {
+		return "", authOpts, fmt.Errorf("DATABASE_URL is required")
+	}
+
+	if method := os.Getenv("AUTH_METHOD"); method != "" {
+		var err error
+		authOpts.AuthMethod, err = ParseAuthMethod(method)
+		if err != nil {
+			return "", authOpts, fmt.Errorf("invalid AUTH_METHOD: %w", err)
+		}
+	}
+
+	switch authOpts.AuthMethod {
+	case StandardAuth:
+	case AWSAuth:
+		authOpts.AWSDBRegion = os.Getenv("AWS_REGION")
+		authOpts.AWSDBUser = os.Getenv("AWS_DB_USER")
+		authOpts.AWSAssumeRoleARN = os.Getenv("AWS_ASSUME_ROLE_ARN")
+		authOpts.AWSExternalID = os.Getenv("AWS_EXTERNAL_ID")
+		authOpts.AWSProfile = os.Getenv("AWS_PROFILE")
+
+		if forceIMDS := os.Getenv("AWS_FORCE_IMDS"); forceIMDS != "" {
+			var err error
+			authOpts.AWSForceIMDS, err = strconv.ParseBool(forceIMDS)
+			if err != nil {
+				return "", authOpts, fmt.Errorf("invalid AWS_FORCE_IMDS %q: %w", forceIMDS, err)
+			}
+		}
+	case GCPAuth:
+		authOpts.GCPCredentialsFile = os.Getenv("GCP_CREDENTIALS_FILE")
+		authOpts.GCPImpersonateServiceAccount = os.Getenv("GCP_IMPERSONATE_SERVICE_ACCOUNT")
+
+		if scopes := os.Getenv("GCP_SCOPES"); scopes != "" {
+			for _, scope := range strings.Split(scopes, ",") {
+				if scope = strings.TrimSpace(scope); scope != "" {
+					authOpts.GCPScopes = append(authOpts.GCPScopes, scope)
+				}
+			}
+		}
+	case AzureAuth:
+		if kind := os.Getenv("AZURE_CREDENTIAL_KIND"); kind != "" {
+			var ok bool
+			authOpts.AzureCredentialKind, ok = azureCredentialKinds[kind]
+			if !ok {
+				return "", authOpts, fmt.Errorf("invalid AZURE_CREDENTIAL_KIND %q, must be one of msi, cli, environment or default", kind)
+			}
+		}
+
+		if azureCloud := os.Getenv("AZURE_CLOUD"); azureCloud != "" {
+			var ok bool
+			authOpts.AzureCloud, ok = azureClouds[azureCloud]
+			if !ok {
+				return "", authOpts, fmt.Errorf("invalid AZURE_CLOUD %q, must be one of public, usgovernment or china", azureCloud)
+			}
+		}
+
+		// the other kinds read AZURE_CLIENT_ID themselves where they use it
+		if authOpts.AzureCredentialKind == AzureMSI {
+			authOpts.AzureClientID = os.Getenv("AZURE_CLIENT_ID")
+		}
+
+		if workloadIdentity := os.Getenv("AZURE_USE_WORKLOAD_IDENTITY"); workloadIdentity != "" {
+			var err error
+			authOpts.AzureUseWorkloadIdentity, err = strconv.ParseBool(workloadIdentity)
+			if err != nil {
+				return "", authOpts, fmt.Errorf("invalid AZURE_USE_WORKLOAD_IDENTITY %q: %w", workloadIdentity, err)
+			}
+		}
+	default:
+		return "", authOpts, fmt.Errorf("AUTH_METHOD %s is not supported from the environment, use NewConfig with its options", authOpts.AuthMethod)
+	}
+
+	return connString, authOpts, nil
+}
@@ -0,0 +1,131 @@
+// Copyright IBM Corp. 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package pgmultiauth
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/aws/smithy-go"
+	"github.com/hashicorp/vault/api"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+var (
+	// ErrInvalidConfig is matched by errors returned for a Config
+	// that fails validation.
+	ErrInvalidConfig = errors.New("invalid auth configuration")
+
+	// ErrTokenFetch is matched by errors returned when an auth token
+	// could not be fetched, after all retries are exhausted.
+	ErrTokenFetch = errors.New("fetching auth token")
+)
+
+// IsAuthError reports whether err was caused by failing to fetch an auth
+// token, e.g. when a connection of a pool could not be authenticated. It
+// distinguishes auth failures from network and database errors.
+func IsAuthError(err error) bool {
+	return errors.Is(err, ErrTokenFetch)
+}
+
+// ConfigValidationError describes why a Config failed validation.
+// It matches ErrInvalidConfig with errors.Is.
+type ConfigValidationError struct {
+	Err error
+}
+
+func (e *ConfigValidationError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ConfigValidationError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrInvalidConfig.
+func (e *ConfigValidationError) Is(target error) bool {
+	return target == ErrInvalidConfig
+}
+
+// ParseError describes why a connection string could not be parsed, e.g. an
+// invalid sslmode. Err is the error returned by pgx, a *pgconn.ParseConfigError
+// in most cases.
+type ParseError struct {
+	// ConnString is the connection string that failed to parse, with its
+	// password redacted, see RedactConnString
+	ConnString string
+	Err        error
+}
+
+func (e *ParseError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// permanentAWSErrorCodes are the codes of AWS API errors caused by missing
+// permissions or invalid credentials.
+var permanentAWSErrorCodes = map[string]bool{
+	"AccessDenied":                true,
+	"AccessDeniedException":       true,
+	"InvalidClientTokenId":        true,
+	"UnrecognizedClientException": true,
+	"SignatureDoesNotMatch":       true,
+	"IncompleteSignature":         true,
+}
+
+// isPermanentTokenError reports whether err is a credential or permission
+// error which retrying won't resolve, e.g. an IAM role that isn't granted or
+// an invalid client ID. Network errors, throttling and server errors are
+// considered transient.
+func isPermanentTokenError(err error) bool {
+	var awsErr smithy.APIError
+	if errors.As(err, &awsErr) {
+		return permanentAWSErrorCodes[awsErr.ErrorCode()]
+	}
+
+	var azureAuthErr *azidentity.AuthenticationFailedError
+	if errors.As(err, &azureAuthErr) {
+		return azureAuthErr.RawResponse == nil || isPermanentStatus(azureAuthErr.RawResponse.StatusCode)
+	}
+
+	// e.g. azidentity.CredentialUnavailableError when no managed identity is available
+	var nonRetriable interface{ NonRetriable() }
+	if errors.As(err, &nonRetriable) {
+		return true
+	}
+
+	var azureErr *azcore.ResponseError
+	if errors.As(err, &azureErr) {
+		return isPermanentStatus(azureErr.StatusCode)
+	}
+
+	var oauthErr *oauth2.RetrieveError
+	if errors.As(err, &oauthErr) {
+		return oauthErr.Response != nil && isPermanentStatus(oauthErr.Response.StatusCode)
+	}
+
+	var googleErr *googleapi.Error
+	if errors.As(err, &googleErr) {
+		return isPermanentStatus(googleErr.Code)
+	}
+
+	var vaultErr *api.ResponseError
+	if errors.As(err, &vaultErr) {
+		return isPermanentStatus(vaultErr.StatusCode)
+	}
+
+	return false
+}
+
+// isPermanentStatus reports whether a token request failing with the HTTP
+// status code fails again when retried.
+func isPermanentStatus(code int) bool {
+	return code == http.StatusBadRequest || code == http.StatusUnauthorized || code == http.StatusForbidden
+}
@@ -5,34 +5,277 @@ package pgmultiauth
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"os"
+	"strings"
+	"time"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
+	"golang.org/x/oauth2/google/downscope"
+	"google.golang.org/api/idtoken"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
 )
 
+// defaultGCPScope is the OAuth scope requested for GCP credentials unless
+// DefaultAuthConfigOptions.GCPScopes is set.
+const defaultGCPScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// findGCPDefaultCredentials looks up Application Default Credentials. It is a
+// variable so that tests can avoid depending on the environment.
+var findGCPDefaultCredentials = google.FindDefaultCredentials
+
+// newGCPImpersonatedTokenSource creates the token source used for service
+// account impersonation. It is a variable so that tests can avoid calling
+// the IAM Credentials API.
+var newGCPImpersonatedTokenSource = impersonate.CredentialsTokenSource
+
+// newGCPDownscopedTokenSource creates the token source used for Credential
+// Access Boundaries. It is a variable so that tests can avoid calling the
+// Security Token Service API.
+var newGCPDownscopedTokenSource = downscope.NewTokenSource
+
+// newGCPIDTokenSource creates the token source used for ID tokens. It is a
+// variable so that tests can avoid calling the Google token endpoints.
+var newGCPIDTokenSource = idtoken.NewTokenSource
+
 type gcpTokenConfig struct {
 	creds *google.Credentials
+	// Optional database user issued along with the tokens
+	user string
+	// Optional rules the tokens are downscoped to
+	accessBoundary []downscope.AccessBoundaryRule
+	// Optional audience of ID tokens issued instead of access tokens
+	idTokenAudience *string
+
+	refreshBuffer time.Duration
+	clock         func() time.Time
 }
 
 func (c gcpTokenConfig) generateToken(ctx context.Context) (*authToken, error) {
-	token, err := c.fetchGCPAuthToken()
+	token, err := c.fetchGCPAuthToken(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("fetching gcp token: %v", err)
+		return nil, fmt.Errorf("fetching gcp token: %w", err)
+	}
+
+	// Tokens without an expiry never expire
+	validFn := func() bool { return true }
+	if !token.Expiry.IsZero() {
+		// Consider the token expired refreshBuffer before actual expiry to
+		// account for network latency. Token sources return their cached token
+		// until shortly before it expires, so a token that is already within
+		// refreshBuffer of its expiry is used until it expires.
+		buffer := c.refreshBuffer
+		if !token.Expiry.Add(-buffer).After(c.clock()) {
+			buffer = 0
+		}
+		validFn = validBefore(c.clock, token.Expiry, buffer)
+	}
+
+	return &authToken{token: token.AccessToken, username: c.user, valid: validFn, expiresAt: token.Expiry}, nil
+}
+
+func (c gcpTokenConfig) fetchGCPAuthToken(ctx context.Context) (*oauth2.Token, error) {
+	tokenSource, err := c.tokenSource(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		token *oauth2.Token
+		err   error
+	}
+
+	// oauth2.TokenSource doesn't take a context, fetch the token in the
+	// background so that the caller doesn't wait for it once ctx is done
+	done := make(chan result, 1)
+	go func() {
+		token, err := tokenSource.Token()
+		done <- result{token: token, err: err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, fmt.Errorf("failed to get token: %w", ctx.Err())
+	case r := <-done:
+		if r.err != nil {
+			return nil, fmt.Errorf("failed to get token: %w", r.err)
+		}
+
+		return r.token, nil
+	}
+}
+
+// tokenSource returns the token source of the credentials, downscoped to the
+// access boundary if one is configured.
+func (c gcpTokenConfig) tokenSource(ctx context.Context) (oauth2.TokenSource, error) {
+	if c.idTokenAudience != nil {
+		ts, err := newGCPIDTokenSource(ctx, *c.idTokenAudience, option.WithCredentials(c.creds))
+		if err != nil {
+			return nil, fmt.Errorf("creating ID token source: %w", err)
+		}
+
+		return ts, nil
+	}
+
+	if len(c.accessBoundary) == 0 {
+		return c.creds.TokenSource, nil
 	}
 
-	validFn := func() bool { return token.Valid() }
+	ts, err := newGCPDownscopedTokenSource(ctx, downscope.DownscopingConfig{
+		RootSource: c.creds.TokenSource,
+		Rules:      c.accessBoundary,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("creating downscoped token source: %w", err)
+	}
 
-	return &authToken{token: token.AccessToken, valid: validFn}, nil
+	return ts, nil
 }
 
-func (c gcpTokenConfig) fetchGCPAuthToken() (*oauth2.Token, error) {
-	token, err := c.creds.TokenSource.Token()
+// impersonateGCPServiceAccount returns credentials whose tokens are issued for
+// targetServiceAccount, using creds as the base identity. The base identity
+// needs the Service Account Token Creator role on the target service account.
+func impersonateGCPServiceAccount(ctx context.Context, creds *google.Credentials, targetServiceAccount, userAgent string, scopes []string) (*google.Credentials, error) {
+	opts := []option.ClientOption{option.WithCredentials(creds)}
+	if userAgent != "" {
+		opts = append(opts, option.WithUserAgent(userAgent))
+	}
+
+	ts, err := newGCPImpersonatedTokenSource(ctx, impersonate.CredentialsConfig{
+		TargetPrincipal: targetServiceAccount,
+		Scopes:          scopes,
+	}, opts...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get token: %w", err)
+		return nil, fmt.Errorf("creating impersonated token source: %w", err)
 	}
 
-	return token, nil
+	// Describe the impersonated account like credentials files do, so that
+	// the database user can be derived from it
+	credsJSON, err := json.Marshal(map[string]string{
+		"type":                              "impersonated_service_account",
+		"service_account_impersonation_url": gcpImpersonationURLPrefix + targetServiceAccount + ":generateAccessToken",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("encoding impersonated credentials: %w", err)
+	}
+
+	return &google.Credentials{
+		ProjectID:   creds.ProjectID,
+		TokenSource: ts,
+		JSON:        credsJSON,
+	}, nil
+}
+
+// gcpImpersonationURLPrefix is the prefix of the service account
+// impersonation URL of credentials, followed by the service account email.
+const gcpImpersonationURLPrefix = "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/"
+
+// maxPostgresIdentifierLength is the maximum length of PostgreSQL identifiers,
+// longer user names are truncated by the server.
+const maxPostgresIdentifierLength = 63
+
+// GCPIAMDatabaseUser returns the name of the Cloud SQL IAM database user of
+// the service account creds authenticate as: its email without the
+// ".gserviceaccount.com" suffix, truncated to 63 characters. The service
+// account is read from the JSON of service account keys and of credentials
+// impersonating a service account. It fails for other credentials, e.g.
+// credentials of the metadata server or user accounts.
+func GCPIAMDatabaseUser(creds *google.Credentials) (string, error) {
+	if creds == nil {
+		return "", fmt.Errorf("gcp credentials are required")
+	}
+
+	if len(creds.JSON) == 0 {
+		return "", fmt.Errorf("gcp credentials have no JSON to read the service account from")
+	}
+
+	var file struct {
+		Type             string `json:"type"`
+		ClientEmail      string `json:"client_email"`
+		ImpersonationURL string `json:"service_account_impersonation_url"`
+	}
+	if err := json.Unmarshal(creds.JSON, &file); err != nil {
+		return "", fmt.Errorf("parsing gcp credentials JSON: %w", err)
+	}
+
+	email := file.ClientEmail
+	if file.ImpersonationURL != "" {
+		// e.g. ".../serviceAccounts/sa@project.iam.gserviceaccount.com:generateAccessToken"
+		_, account, ok := strings.Cut(file.ImpersonationURL, "/serviceAccounts/")
+		if !ok {
+			return "", fmt.Errorf("invalid service account impersonation URL %q", file.ImpersonationURL)
+		}
+		email, _, _ = strings.Cut(account, ":")
+	}
+
+	if email == "" {
+		return "", fmt.Errorf("gcp credentials of type %q do not contain a service account email", file.Type)
+	}
+
+	user := strings.TrimSuffix(email, ".gserviceaccount.com")
+	if len(user) > maxPostgresIdentifierLength {
+		user = user[:maxPostgresIdentifierLength]
+	}
+
+	return user, nil
+}
+
+// gcpUser returns the database user for the Google credentials, unless the
+// user is set with WithConnectUser or the connection string. It is empty if
+// the credentials don't identify a service account, the user pgx defaults to
+// is used then.
+func (c Config) gcpUser() string {
+	if c.connectUser != "" || c.hasConnStringUser() {
+		return ""
+	}
+
+	user, err := GCPIAMDatabaseUser(c.googleCreds)
+	if err != nil {
+		return ""
+	}
+
+	return user
+}
+
+// gcpCredentialsFromFile loads credentials with the given scopes from a
+// JSON key file, e.g. a service account key downloaded from the console.
+func gcpCredentialsFromFile(ctx context.Context, path string, scopes []string) (*google.Credentials, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading credentials file: %w", err)
+	}
+
+	creds, err := google.CredentialsFromJSON(ctx, data, scopes...)
+	if err != nil {
+		return nil, fmt.Errorf("parsing credentials file %q: %w", path, err)
+	}
+
+	if err := validateGCPConfig(creds); err != nil {
+		return nil, fmt.Errorf("invalid credentials file %q: %w", path, err)
+	}
+
+	return creds, nil
+}
+
+func (c gcpTokenConfig) validate() error {
+	if err := validateGCPConfig(c.creds); err != nil {
+		return fmt.Errorf("invalid GCP config: %w", err)
+	}
+
+	if c.idTokenAudience != nil {
+		if strings.TrimSpace(*c.idTokenAudience) == "" {
+			return fmt.Errorf("invalid GCP config: ID token audience cannot be empty")
+		}
+
+		if len(c.accessBoundary) > 0 {
+			return fmt.Errorf("invalid GCP config: ID tokens cannot be downscoped to a credential access boundary")
+		}
+	}
+
+	return nil
 }
 
 func validateGCPConfig(creds *google.Credentials) error {
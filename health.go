@@ -0,0 +1,67 @@
+// Copyright IBM Corp. 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package pgmultiauth
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// HealthCheck verifies that a connection can be authenticated and the database
+// is reachable, e.g. for readiness probes. It gets a valid auth token, fetching
+// a new one if the cached token has expired, and then connects with it and
+// pings the database. The returned error tells which stage failed, errors
+// fetching the token match ErrTokenFetch. It connects with the connection
+// string set by WithDirectAuthConnString if any.
+func HealthCheck(ctx context.Context, config Config) error {
+	if err := config.validate(); err != nil {
+		return fmt.Errorf("invalid auth configuration: %w", err)
+	}
+	config = config.directAuthConfig()
+
+	connConfig, err := config.parseConnConfig()
+	if err != nil {
+		return fmt.Errorf("failed to parse database connection string: %w", err)
+	}
+
+	// The dialer is only needed for this check, don't leave it to Close
+	probe := config
+	probe.resources = &resources{}
+	defer probe.Close()
+
+	if err := probe.installConnectorDialer(ctx, connConfig); err != nil {
+		return err
+	}
+
+	if config.authConfigured() {
+		token, err := config.tokenCache().get(ctx, config)
+		if err != nil {
+			return fmt.Errorf("health check: getting db token: %w", err)
+		}
+
+		token.apply(connConfig)
+	} else if config.password != "" {
+		connConfig.Password = config.password
+	}
+
+	if config.beforeConnectFn != nil {
+		if err := config.beforeConnectFn(ctx, connConfig); err != nil {
+			return fmt.Errorf("health check: before connect: %w", err)
+		}
+	}
+
+	conn, err := pgx.ConnectConfig(ctx, connConfig)
+	if err != nil {
+		return fmt.Errorf("health check: connecting to database: %w", err)
+	}
+	defer conn.Close(ctx)
+
+	if err := conn.Ping(ctx); err != nil {
+		return fmt.Errorf("health check: pinging database: %w", err)
+	}
+
+	return nil
+}
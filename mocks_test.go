@@ -5,22 +5,636 @@ package pgmultiauth
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
 	"time"
 
+	"cloud.google.com/go/alloydbconn"
+	"cloud.google.com/go/cloudsqlconn"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	ststypes "github.com/aws/aws-sdk-go-v2/service/sts/types"
+	"github.com/hashicorp/vault/api"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"golang.org/x/oauth2"
 )
 
 // MockTokenCredential is a mock implementation of azcore.TokenCredential
 type MockTokenCredential struct {
+	mu sync.Mutex
+
 	Token  string
 	Expiry time.Time
+	// Lifetime sets the expiry of every returned token relative to
+	// the time of the request, overriding Expiry
+	Lifetime time.Duration
+	// RefreshOn is the suggested refresh time of every returned token
+	RefreshOn time.Time
+	// Err is returned instead of a token when set
+	Err error
+
+	// Options records the options of the last token request
+	Options policy.TokenRequestOptions
+	// Calls counts the token requests
+	Calls int
 }
 
 // GetToken implements the azcore.TokenCredential interface
 func (m *MockTokenCredential) GetToken(ctx context.Context, options policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.Options = options
+	m.Calls++
+
+	if err := ctx.Err(); err != nil {
+		return azcore.AccessToken{}, err
+	}
+
+	if m.Err != nil {
+		return azcore.AccessToken{}, m.Err
+	}
+
+	expiry := m.Expiry
+	if m.Lifetime > 0 {
+		expiry = time.Now().Add(m.Lifetime)
+	}
+
 	return azcore.AccessToken{
 		Token:     m.Token,
-		ExpiresOn: m.Expiry,
+		ExpiresOn: expiry,
+		RefreshOn: m.RefreshOn,
 	}, nil
 }
+
+// CallCount returns the number of token requests, safe for concurrent use
+func (m *MockTokenCredential) CallCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.Calls
+}
+
+// MockVaultLogical is a mock implementation of vaultLogicalReader
+type MockVaultLogical struct {
+	Secret *api.Secret
+	Err    error
+
+	// Path records the last path that was read
+	Path string
+	// Reads counts the reads
+	Reads int
+}
+
+// ReadWithContext implements the vaultLogicalReader interface
+func (m *MockVaultLogical) ReadWithContext(ctx context.Context, path string) (*api.Secret, error) {
+	m.Path = path
+	m.Reads++
+	return m.Secret, m.Err
+}
+
+// MockVaultSys is a mock implementation of vaultLeaseRenewer
+type MockVaultSys struct {
+	Secret *api.Secret
+	Err    error
+
+	// LeaseIDs records the IDs of the renewed leases
+	LeaseIDs []string
+}
+
+// RenewWithContext implements the vaultLeaseRenewer interface
+func (m *MockVaultSys) RenewWithContext(ctx context.Context, id string, increment int) (*api.Secret, error) {
+	m.LeaseIDs = append(m.LeaseIDs, id)
+	return m.Secret, m.Err
+}
+
+// MockSTSClient is a mock implementation of stscreds.AssumeRoleAPIClient
+type MockSTSClient struct {
+	AccessKeyID string
+
+	// Input records the input of the last AssumeRole call
+	Input *sts.AssumeRoleInput
+}
+
+// AssumeRole implements the stscreds.AssumeRoleAPIClient interface
+func (m *MockSTSClient) AssumeRole(ctx context.Context, params *sts.AssumeRoleInput, optFns ...func(*sts.Options)) (*sts.AssumeRoleOutput, error) {
+	m.Input = params
+
+	return &sts.AssumeRoleOutput{
+		Credentials: &ststypes.Credentials{
+			AccessKeyId:     aws.String(m.AccessKeyID),
+			SecretAccessKey: aws.String("assumed-secret"),
+			SessionToken:    aws.String("assumed-session-token"),
+			Expiration:      aws.Time(time.Now().Add(time.Hour)),
+		},
+	}, nil
+}
+
+// MockCloudSQLDialer is a mock implementation of cloudSQLDialer
+type MockCloudSQLDialer struct {
+	mu sync.Mutex
+
+	// Err is returned by every Dial call
+	Err error
+
+	// Closed is set once the dialer is closed
+	Closed bool
+
+	// Instances records the instance connection names that were dialed
+	Instances []string
+}
+
+// Dial implements the cloudSQLDialer interface
+func (m *MockCloudSQLDialer) Dial(ctx context.Context, icn string, opts ...cloudsqlconn.DialOption) (net.Conn, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.Instances = append(m.Instances, icn)
+	return nil, m.Err
+}
+
+// Close implements the cloudSQLDialer interface
+func (m *MockCloudSQLDialer) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.Closed = true
+	return nil
+}
+
+// withMockCloudSQLDialer replaces newCloudSQLDialer with a factory returning
+// dialer for the duration of the test and records the options it is called with.
+func withMockCloudSQLDialer(t *testing.T, dialer *MockCloudSQLDialer) *[]cloudsqlconn.Option {
+	var opts []cloudsqlconn.Option
+	original := newCloudSQLDialer
+	t.Cleanup(func() { newCloudSQLDialer = original })
+
+	newCloudSQLDialer = func(ctx context.Context, o ...cloudsqlconn.Option) (cloudSQLDialer, error) {
+		opts = o
+		return dialer, nil
+	}
+
+	return &opts
+}
+
+// MockAlloyDBDialer is a mock implementation of alloyDBDialer
+type MockAlloyDBDialer struct {
+	mu sync.Mutex
+
+	// Err is returned by every Dial call
+	Err error
+
+	// Closed is set once the dialer is closed
+	Closed bool
+
+	// Instances records the instance URIs that were dialed
+	Instances []string
+}
+
+// Dial implements the alloyDBDialer interface
+func (m *MockAlloyDBDialer) Dial(ctx context.Context, instance string, opts ...alloydbconn.DialOption) (net.Conn, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.Instances = append(m.Instances, instance)
+	return nil, m.Err
+}
+
+// Close implements the alloyDBDialer interface
+func (m *MockAlloyDBDialer) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.Closed = true
+	return nil
+}
+
+// withMockAlloyDBDialer replaces newAlloyDBDialer with a factory returning
+// dialer for the duration of the test and records the options it is called with.
+func withMockAlloyDBDialer(t *testing.T, dialer *MockAlloyDBDialer) *[]alloydbconn.Option {
+	var opts []alloydbconn.Option
+	original := newAlloyDBDialer
+	t.Cleanup(func() { newAlloyDBDialer = original })
+
+	newAlloyDBDialer = func(ctx context.Context, o ...alloydbconn.Option) (alloyDBDialer, error) {
+		opts = o
+		return dialer, nil
+	}
+
+	return &opts
+}
+
+// blockingTokenSource is an oauth2.TokenSource whose Token calls block
+// until release is closed.
+type blockingTokenSource struct {
+	release chan struct{}
+}
+
+// Token implements the oauth2.TokenSource interface
+func (s blockingTokenSource) Token() (*oauth2.Token, error) {
+	<-s.release
+	return &oauth2.Token{AccessToken: "late-token"}, nil
+}
+
+// countingTokenSource is an oauth2.TokenSource returning the same token,
+// like a reusing token source does until shortly before its expiry.
+type countingTokenSource struct {
+	token *oauth2.Token
+	calls *atomic.Int32
+}
+
+// Token implements the oauth2.TokenSource interface
+func (s countingTokenSource) Token() (*oauth2.Token, error) {
+	s.calls.Add(1)
+	return s.token, nil
+}
+
+// noopTracer is a pgx.QueryTracer which does nothing
+type noopTracer struct{}
+
+// TraceQueryStart implements the pgx.QueryTracer interface
+func (noopTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, _ pgx.TraceQueryStartData) context.Context {
+	return ctx
+}
+
+// TraceQueryEnd implements the pgx.QueryTracer interface
+func (noopTracer) TraceQueryEnd(context.Context, *pgx.Conn, pgx.TraceQueryEndData) {}
+
+// newGCPServiceAccountKeyFile writes a service account key file with a freshly
+// generated private key whose tokens are requested from tokenURL.
+func newGCPServiceAccountKeyFile(t *testing.T, tokenURL string) string {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating private key: %v", err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshaling private key: %v", err)
+	}
+
+	data, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"project_id":     "test-project",
+		"private_key_id": "key-id",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"client_email":   "db-user@test-project.iam.gserviceaccount.com",
+		"client_id":      "123456789",
+		"token_uri":      tokenURL,
+	})
+	if err != nil {
+		t.Fatalf("marshaling key file: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "service-account.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("writing key file: %v", err)
+	}
+
+	return path
+}
+
+// newMockGCPTokenServer returns a test server issuing accessToken for
+// service account JWT grants.
+func newMockGCPTokenServer(t *testing.T, accessToken string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"access_token": accessToken,
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// newMockVaultClient returns a Vault client backed by a test server which
+// serves secrets keyed by their path (e.g. "database/creds/app").
+func newMockVaultClient(t *testing.T, secrets map[string]*api.Secret) *api.Client {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret, ok := secrets[strings.TrimPrefix(r.URL.Path, "/v1/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(secret)
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := api.NewClient(&api.Config{Address: server.URL})
+	if err != nil {
+		t.Fatalf("creating vault client: %v", err)
+	}
+	client.SetToken("test-token")
+
+	return client
+}
+
+// mockVaultAppRoleServer is a Vault test server with an AppRole auth method
+// mounted at "approle". Secrets are only served to tokens issued by a login.
+type mockVaultAppRoleServer struct {
+	RoleID   string
+	SecretID string
+	// TokenTTL and RenewTTL are the lease durations in seconds of logins and renewals
+	TokenTTL int
+	RenewTTL int
+
+	Logins   atomic.Int32
+	Renewals atomic.Int32
+
+	mu     sync.Mutex
+	tokens map[string]bool
+}
+
+// newMockVaultAppRoleClient starts server and returns a client without a
+// token for it, which serves secrets keyed by their path.
+func newMockVaultAppRoleClient(t *testing.T, server *mockVaultAppRoleServer, secrets map[string]*api.Secret) *api.Client {
+	t.Helper()
+
+	server.tokens = make(map[string]bool)
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch path := strings.TrimPrefix(r.URL.Path, "/v1/"); path {
+		case "auth/approle/login":
+			var body struct {
+				RoleID   string `json:"role_id"`
+				SecretID string `json:"secret_id"`
+			}
+			_ = json.NewDecoder(r.Body).Decode(&body)
+			if body.RoleID != server.RoleID || body.SecretID != server.SecretID {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"errors":["invalid role or secret ID"]}`))
+				return
+			}
+
+			token := "approle-token-" + strconv.Itoa(int(server.Logins.Add(1)))
+			server.mu.Lock()
+			server.tokens[token] = true
+			server.mu.Unlock()
+
+			_ = json.NewEncoder(w).Encode(&api.Secret{Auth: &api.SecretAuth{
+				ClientToken:   token,
+				LeaseDuration: server.TokenTTL,
+				Renewable:     true,
+			}})
+		case "auth/token/renew-self":
+			if !server.issued(r.Header.Get("X-Vault-Token")) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			server.Renewals.Add(1)
+			_ = json.NewEncoder(w).Encode(&api.Secret{Auth: &api.SecretAuth{
+				ClientToken:   r.Header.Get("X-Vault-Token"),
+				LeaseDuration: server.RenewTTL,
+				Renewable:     true,
+			}})
+		default:
+			secret, ok := secrets[path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			if !server.issued(r.Header.Get("X-Vault-Token")) {
+				w.WriteHeader(http.StatusForbidden)
+				_, _ = w.Write([]byte(`{"errors":["permission denied"]}`))
+				return
+			}
+
+			_ = json.NewEncoder(w).Encode(secret)
+		}
+	}))
+	t.Cleanup(httpServer.Close)
+
+	client, err := api.NewClient(&api.Config{Address: httpServer.URL})
+	if err != nil {
+		t.Fatalf("creating vault client: %v", err)
+	}
+	client.ClearToken()
+
+	return client
+}
+
+// issued checks if token was issued by a login.
+func (s *mockVaultAppRoleServer) issued(token string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tokens[token]
+}
+
+// tokenFetchRecord is a single recorded call of MetricsHook.OnTokenFetch
+type tokenFetchRecord struct {
+	method   AuthMethod
+	duration time.Duration
+	err      error
+}
+
+// recordingMetricsHook is a MetricsHook recording all token fetches
+type recordingMetricsHook struct {
+	mu      sync.Mutex
+	fetches []tokenFetchRecord
+}
+
+// OnTokenFetch implements the MetricsHook interface
+func (h *recordingMetricsHook) OnTokenFetch(method AuthMethod, duration time.Duration, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.fetches = append(h.fetches, tokenFetchRecord{method: method, duration: duration, err: err})
+}
+
+// fakePostgresServer accepts connections and records whether clients
+// requested TLS before refusing to serve them
+type fakePostgresServer struct {
+	addr         string
+	sslRequested atomic.Bool
+}
+
+// sslRequestCode is the protocol code of a Postgres SSLRequest message
+const sslRequestCode = 80877103
+
+func newFakePostgresServer(t *testing.T) *fakePostgresServer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	server := &fakePostgresServer{addr: listener.Addr().String()}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				// The first message is either an SSLRequest or a StartupMessage,
+				// both start with their length and protocol code
+				header := make([]byte, 8)
+				if _, err := io.ReadFull(conn, header); err != nil {
+					return
+				}
+
+				if binary.BigEndian.Uint32(header[4:]) == sslRequestCode {
+					server.sslRequested.Store(true)
+					_, _ = conn.Write([]byte("N"))
+				}
+			}()
+		}
+	}()
+
+	return server
+}
+
+// newPasswordRecordingServer returns the address of a Postgres test server
+// which asks for a cleartext password, records it and rejects it. The
+// passwords are sent on the returned channel.
+func newPasswordRecordingServer(t *testing.T) (string, <-chan string) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	passwords := make(chan string, 16)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				backend := pgproto3.NewBackend(conn, conn)
+				msg, err := backend.ReceiveStartupMessage()
+				if err != nil {
+					return
+				}
+				if _, ok := msg.(*pgproto3.SSLRequest); ok {
+					if _, err := conn.Write([]byte("N")); err != nil {
+						return
+					}
+					if _, err := backend.ReceiveStartupMessage(); err != nil {
+						return
+					}
+				}
+
+				backend.Send(&pgproto3.AuthenticationCleartextPassword{})
+				if err := backend.Flush(); err != nil {
+					return
+				}
+				if err := backend.SetAuthType(pgproto3.AuthTypeCleartextPassword); err != nil {
+					return
+				}
+
+				reply, err := backend.Receive()
+				if err != nil {
+					return
+				}
+				if password, ok := reply.(*pgproto3.PasswordMessage); ok {
+					passwords <- password.Password
+				}
+
+				backend.Send(&pgproto3.ErrorResponse{Severity: "FATAL", Code: "28P01", Message: "password authentication failed"})
+				_ = backend.Flush()
+			}()
+		}
+	}()
+
+	return listener.Addr().String(), passwords
+}
+
+// closedAddr returns the address of a port nothing listens on, so that
+// connecting to it is refused.
+func closedAddr(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	addr := listener.Addr().String()
+	_ = listener.Close()
+
+	return addr
+}
+
+// withClock sets the clock used to compute token expiry
+func withClock(clock func() time.Time) ConfigOpt {
+	return func(c *Config) {
+		c.clock = clock
+	}
+}
+
+// fakeClock is a manually advanced clock for token expiry tests
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+// Now returns the current time of the clock
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// MockTokenGenerator is a mock implementation of TokenGenerator
+type MockTokenGenerator struct {
+	// Token and Err are returned by every GenerateToken call
+	Token Token
+	Err   error
+
+	// Calls counts the GenerateToken calls
+	Calls int
+}
+
+// GenerateToken implements the TokenGenerator interface
+func (m *MockTokenGenerator) GenerateToken(ctx context.Context) (Token, error) {
+	m.Calls++
+	return m.Token, m.Err
+}
@@ -5,22 +5,31 @@ package pgmultiauth
 
 import (
 	"context"
+	"crypto/tls"
 	"database/sql"
 	"database/sql/driver"
+	"errors"
 	"fmt"
+	"maps"
 	"net/url"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 
+	"cloud.google.com/go/alloydbconn"
+	"cloud.google.com/go/cloudsqlconn"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/avast/retry-go/v4"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/api"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/jackc/pgx/v5/stdlib"
 	"golang.org/x/oauth2/google"
+	"golang.org/x/oauth2/google/downscope"
 )
 
 // AuthMethod represents the type of authentication method used
@@ -32,333 +41,1968 @@ const (
 	AWSAuth                        // AWS authentication
 	GCPAuth                        // GCP authentication
 	AzureAuth                      // Azure authentication
+	VaultAuth                      // Vault authentication
+	CloudSQLAuth                   // GCP Cloud SQL connector with IAM authentication
+	CustomAuth                     // Tokens from a custom token generator
+	AlloyDBAuth                    // GCP AlloyDB connector with IAM authentication
 )
 
+// String returns the name of the authentication method, e.g. "aws".
+func (m AuthMethod) String() string {
+	switch m {
+	case StandardAuth:
+		return "standard"
+	case AWSAuth:
+		return "aws"
+	case GCPAuth:
+		return "gcp"
+	case AzureAuth:
+		return "azure"
+	case VaultAuth:
+		return "vault"
+	case CloudSQLAuth:
+		return "cloudsql"
+	case CustomAuth:
+		return "custom"
+	case AlloyDBAuth:
+		return "alloydb"
+	default:
+		return fmt.Sprintf("AuthMethod(%d)", int(m))
+	}
+}
+
+// MarshalText implements encoding.TextMarshaler, encoding the authentication
+// method by its name.
+func (m AuthMethod) MarshalText() ([]byte, error) {
+	for _, method := range authMethods {
+		if method == m {
+			return []byte(m.String()), nil
+		}
+	}
+
+	return nil, fmt.Errorf("unsupported authentication method: %d", int(m))
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, decoding the
+// authentication method from its name.
+func (m *AuthMethod) UnmarshalText(text []byte) error {
+	method, err := ParseAuthMethod(string(text))
+	if err != nil {
+		return err
+	}
+
+	*m = method
+	return nil
+}
+
+// ParseAuthMethod returns the authentication method with the given name, e.g.
+// "aws" for AWSAuth. Names are case-insensitive and surrounding whitespace is
+// ignored.
+func ParseAuthMethod(s string) (AuthMethod, error) {
+	name := strings.ToLower(strings.TrimSpace(s))
+	for _, method := range authMethods {
+		if method.String() == name {
+			return method, nil
+		}
+	}
+
+	return StandardAuth, fmt.Errorf("unknown authentication method %q", s)
+}
+
+// authMethods lists all supported authentication methods.
+var authMethods = []AuthMethod{StandardAuth, AWSAuth, GCPAuth, AzureAuth, VaultAuth, CloudSQLAuth, CustomAuth, AlloyDBAuth}
+
 // Config holds the configuration for the database.
 type Config struct {
 	connString string
 	logger     hclog.Logger
 
+	// Parsed connection config, used instead of connString when set
+	connConfig *pgx.ConnConfig
+	// Connection URL connString was created from, used for password
+	// substitution when set so that its userinfo isn't re-parsed
+	connURL *url.URL
+
 	// Enum to specify the authentication method
 	authMethod AuthMethod
 
+	// How long before its expiry a token is considered invalid and refreshed
+	tokenRefreshBuffer time.Duration
+	// Optional validity of tokens from their fetch, overriding their expiry
+	staticTokenExpiry time.Duration
+
+	// clock is used to compute token expiry, defaults to time.Now
+	clock func() time.Time
+
+	// Retry policy for fetching auth tokens
+	retryAttempts uint
+	retryDelay    time.Duration
+	// Optional cap on the exponential backoff between retries
+	retryMaxDelay time.Duration
+	// Optional timeout of a single token fetch attempt
+	tokenFetchTimeout time.Duration
+	// Optional timeout of the initial token fetch and of dialing
+	connectTimeout time.Duration
+
+	// Optional hook receiving token fetch metrics
+	metricsHook MetricsHook
+
+	// Optional callback receiving every newly fetched token
+	tokenRefreshFn func(token string, expiresAt time.Time)
+
+	// Optional function reloading the credentials after a failed token fetch
+	credentialReloader func(ctx context.Context) error
+
+	// Optional context bounding the background token refresh,
+	// background refresh is disabled when nil
+	backgroundRefreshCtx context.Context
+
+	// Optional callback customizing the pool config in NewDBPool
+	poolConfigFn func(*pgxpool.Config)
+
+	// Optional hook run before connecting, after the auth token is set
+	beforeConnectFn func(context.Context, *pgx.ConnConfig) error
+
+	// Disables pinging pooled connections before they are acquired
+	disableAcquirePing bool
+
+	// Optional tracer set on every connection config
+	tracer pgx.QueryTracer
+
+	// Rejects connections without TLS
+	requireTLS bool
+	// Optional user overriding the user of the connection string
+	connectUser string
+	// Optional user agent of the cloud SDK clients created by DefaultConfig
+	userAgent string
+	// Optional query exec mode and statement cache capacity, overriding
+	// the connection string when set
+	queryExecMode          *pgx.QueryExecMode
+	statementCacheCapacity *int
+	// Optional TLS config overriding the one parsed from the connection string
+	tlsConfig *tls.Config
+	// Optional server name verified instead of the dialed host
+	tlsServerName string
+
+	// Optional application_name of the connections, replacing the one of the
+	// connection string only if overrideApplicationName is set
+	applicationName         string
+	overrideApplicationName bool
+	// Optional runtime params of the connections, not replacing those of the
+	// connection string
+	runtimeParams map[string]string
+
+	// Optional connection string used to validate credentials, e.g. bypassing PgBouncer
+	directAuthConnString string
+	// Optional function dialing the database, e.g. through a proxy
+	dialFunc pgconn.DialFunc
+	// Optional password of StandardAuth, set before connecting
+	password string
+
+	// Token cache shared by the connectors and pools created from the Config
+	tokens *tokenCache
+	// Token cache of the Config connecting with directAuthConnString
+	directTokens *tokenCache
+
+	// Background goroutines and dialers released by Close, shared by copies of the Config
+	resources *resources
+
+	// Credentials loaded on the first token fetch, set by DefaultConfig
+	// if DefaultAuthConfigOptions.Lazy is set
+	lazyCreds *lazyCredentials
+
 	// AWS Auth
 	// Required if authMethod is AWSAuth
 	// Region and Credentials must be set in awsConfig
 	awsConfig *aws.Config
+	// Optional database user the AWS token is generated for,
+	// defaults to the user of the connection string
+	awsUser string
+	// Optional endpoint the AWS token is signed for,
+	// defaults to the host and port of the connection string
+	awsTokenHost string
+	awsTokenPort uint16
 
 	// Azure Auth
 	// Required if authMethod is AzureAuth
 	azureCreds azcore.TokenCredential
+	// Optional, defaults to the Azure public cloud scope
+	azureScopes []string
+	// Optional cloud selecting the default Azure scope
+	azureCloud AzureCloud
+	// Optional Microsoft Entra ID principal to connect as,
+	// defaults to the user of the connection string
+	azureADUser string
 
 	// GCP Auth
 	// Required if authMethod is GCPAuth
 	googleCreds *google.Credentials
+	// Optional Credential Access Boundary rules the tokens are downscoped to
+	gcpAccessBoundary []downscope.AccessBoundaryRule
+	// Optional audience of ID tokens used instead of access tokens
+	gcpIDTokenAudience *string
+
+	// Vault Auth
+	// Required if authMethod is VaultAuth
+	vaultClient     *api.Client
+	vaultSecretPath string
+	// Optional database secrets engine role, used instead of vaultSecretPath when set
+	vaultDatabaseMount string
+	vaultDatabaseRole  string
+	// Optional KV secrets engine version, detected from the secret if 0
+	vaultKVVersion int
+	// Renewable lease of the credentials, shared by copies of the Config
+	vaultLease *vaultLease
+	// Optional AppRole login, shared by copies of the Config
+	vaultAppRole *vaultAppRole
+
+	// Custom Auth
+	// Required if authMethod is CustomAuth
+	customTokenFn func(ctx context.Context) (string, time.Time, error)
+
+	// Optional generators replacing the built-in ones of auth methods
+	tokenGeneratorOverrides map[AuthMethod]TokenGenerator
+
+	// Cloud SQL connector
+	// Required if authMethod is CloudSQLAuth
+	cloudSQLInstance string
+	// Optional additional dialer options, e.g. credentials
+	cloudSQLOpts []cloudsqlconn.Option
+
+	// AlloyDB connector
+	// Required if authMethod is AlloyDBAuth
+	alloyDBInstance string
+	// Optional additional dialer options, e.g. credentials
+	alloyDBOpts []alloydbconn.Option
+}
+
+const (
+	// defaultTokenRefreshBuffer is the default time before its expiry
+	// at which an auth token is refreshed.
+	defaultTokenRefreshBuffer = time.Minute
+
+	// Default retry policy for fetching auth tokens
+	defaultRetryAttempts = 3
+	defaultRetryDelay    = 50 * time.Millisecond
+)
+
+// MetricsHook receives metrics about auth token fetches, e.g. to track
+// how often tokens are refreshed and how long fetching them takes.
+type MetricsHook interface {
+	// OnTokenFetch is called after every attempt to fetch an auth token
+	// with the time the attempt took and its error, if any.
+	OnTokenFetch(method AuthMethod, duration time.Duration, err error)
 }
 
 // ConfigOpt provides a method to customize a Config.
 type ConfigOpt func(r *Config)
 
-// WithLogger sets the logger for the Config.
+// WithLogger sets the logger for the Config. Token fetches are logged at debug
+// level along with their duration and the expiry of the token, failures at
+// error level. The log lines of a fetch and its retries share a request ID,
+// see ContextWithRequestID. Tokens are never logged.
 func WithLogger(l hclog.Logger) ConfigOpt {
 	return func(c *Config) {
 		c.logger = l.Named("pgmultiauth")
 	}
 }
 
-// WithawsConfig sets the AWS configuration for the database connection.
+// WithTokenRefreshBuffer sets how long before its expiry an auth token is
+// considered invalid and refreshed. Defaults to 1 minute.
+func WithTokenRefreshBuffer(d time.Duration) ConfigOpt {
+	return func(c *Config) {
+		c.tokenRefreshBuffer = d
+	}
+}
+
+// WithStaticTokenExpiry makes auth tokens valid for d from their fetch,
+// overriding the expiry reported by the credentials. This is useful for token
+// sources that don't report an accurate expiry. Tokens are still refreshed the
+// refresh buffer before the forced expiry, so d must be longer than it.
+func WithStaticTokenExpiry(d time.Duration) ConfigOpt {
+	return func(c *Config) {
+		c.staticTokenExpiry = d
+	}
+}
+
+// WithRetryPolicy sets how fetching an auth token is retried. attempts is the
+// total number of attempts, and the delay between attempts grows exponentially
+// from baseDelay up to maxDelay. A zero maxDelay leaves the backoff uncapped.
+// Defaults to 3 attempts with a 50ms base delay.
+func WithRetryPolicy(attempts uint, baseDelay time.Duration, maxDelay time.Duration) ConfigOpt {
+	return func(c *Config) {
+		c.retryAttempts = attempts
+		c.retryDelay = baseDelay
+		c.retryMaxDelay = maxDelay
+	}
+}
+
+// WithTokenFetchTimeout sets how long a single attempt to fetch an auth token
+// may take, e.g. to not wait for a hanging metadata endpoint. Attempts that time
+// out are retried according to the retry policy. Disabled by default.
+func WithTokenFetchTimeout(d time.Duration) ConfigOpt {
+	return func(c *Config) {
+		c.tokenFetchTimeout = d
+	}
+}
+
+// WithConnectTimeout bounds the time spent getting a usable connection. It
+// limits the initial token fetch, including retries, and sets the
+// ConnectTimeout of the connection config, which bounds dialing and the
+// startup of every connection. Disabled by default.
+func WithConnectTimeout(d time.Duration) ConfigOpt {
+	return func(c *Config) {
+		c.connectTimeout = d
+	}
+}
+
+// WithMetricsHook sets the hook receiving auth token fetch metrics.
+func WithMetricsHook(h MetricsHook) ConfigOpt {
+	return func(c *Config) {
+		c.metricsHook = h
+	}
+}
+
+// WithTokenRefreshCallback sets a function called with every newly fetched
+// auth token and its expiry, e.g. to pass the current password on to other
+// subsystems. The expiry is zero for tokens that don't expire. fn is called
+// after the token is cached, without holding any lock, so it may use the
+// Config, but it should return quickly since connections may wait for it.
+func WithTokenRefreshCallback(fn func(token string, expiresAt time.Time)) ConfigOpt {
+	return func(c *Config) {
+		c.tokenRefreshFn = fn
+	}
+}
+
+// WithCredentialReloader sets a function reloading the underlying credentials,
+// e.g. re-reading rotated keys into the credentials provider. It is called
+// when an attempt to fetch an auth token fails with a credential error that
+// isn't retried otherwise, and the attempt is then retried with the reloaded
+// credentials. Attempts are still limited by WithRetryPolicy, fn isn't called
+// after the last attempt or once ctx is done.
+// fn must not use the Config to connect, it is called while other
+// connections wait for the token.
+func WithCredentialReloader(fn func(ctx context.Context) error) ConfigOpt {
+	return func(c *Config) {
+		c.credentialReloader = fn
+	}
+}
+
+// WithBackgroundRefresh enables refreshing the auth token in the background
+// shortly before it becomes invalid, so that new connections don't block on
+// fetching a token. The refresh runs until ctx is cancelled.
+func WithBackgroundRefresh(ctx context.Context) ConfigOpt {
+	return func(c *Config) {
+		c.backgroundRefreshCtx = ctx
+	}
+}
+
+// WithPoolConfig sets a callback to customize the pool config used by NewDBPool,
+// e.g. to set MaxConns or HealthCheckPeriod. It is called after the connection
+// string is parsed. BeforeConnect and BeforeAcquire hooks set by the callback
+// run after the hooks installed for authentication.
+func WithPoolConfig(fn func(*pgxpool.Config)) ConfigOpt {
+	return func(c *Config) {
+		c.poolConfigFn = fn
+	}
+}
+
+// WithBeforeConnect sets a function run before every connection is
+// established, after the auth token has been set as password. It can adjust
+// the connection config, e.g. its RuntimeParams. Connecting fails with the
+// error it returns.
+func WithBeforeConnect(fn func(ctx context.Context, cfg *pgx.ConnConfig) error) ConfigOpt {
+	return func(c *Config) {
+		c.beforeConnectFn = fn
+	}
+}
+
+// WithApplicationName sets the application_name of the connections, shown in
+// pg_stat_activity, for Open, GetConnector and NewDBPool. An application_name
+// set by the connection string takes precedence, use
+// WithApplicationNameOverride to replace it.
+func WithApplicationName(name string) ConfigOpt {
+	return func(c *Config) {
+		c.applicationName = name
+		c.overrideApplicationName = false
+	}
+}
+
+// WithApplicationNameOverride sets the application_name of the connections
+// like WithApplicationName, replacing one set by the connection string.
+func WithApplicationNameOverride(name string) ConfigOpt {
+	return func(c *Config) {
+		c.applicationName = name
+		c.overrideApplicationName = true
+	}
+}
+
+// WithRuntimeParams sets run-time parameters of the connections, e.g.
+// search_path or statement_timeout, for Open, GetConnector and NewDBPool.
+// Parameters set by the connection string take precedence, as does the
+// application_name set with WithApplicationName, use WithBeforeConnect to
+// replace them. Passing WithRuntimeParams again adds to the parameters.
+func WithRuntimeParams(params map[string]string) ConfigOpt {
+	return func(c *Config) {
+		merged := make(map[string]string, len(c.runtimeParams)+len(params))
+		maps.Copy(merged, c.runtimeParams)
+		maps.Copy(merged, params)
+		c.runtimeParams = merged
+	}
+}
+
+// WithAcquirePingCheck sets whether NewDBPool pings a pooled connection before
+// handing it out. It is enabled by default; disabling it saves a network round
+// trip on every acquire at the cost of possibly returning a broken connection.
+func WithAcquirePingCheck(enabled bool) ConfigOpt {
+	return func(c *Config) {
+		c.disableAcquirePing = !enabled
+	}
+}
+
+// WithTracer sets the tracer of the connection configs used by Open,
+// GetConnector and NewDBPool, e.g. an OpenTelemetry pgx tracer.
+func WithTracer(tracer pgx.QueryTracer) ConfigOpt {
+	return func(c *Config) {
+		c.tracer = tracer
+	}
+}
+
+// WithRequireTLS ensures that auth tokens are never sent over an unencrypted
+// connection. Connection strings with sslmode disable or allow are rejected,
+// and the plaintext fallback of sslmode prefer, the default, is removed so
+// that it behaves like sslmode require.
+func WithRequireTLS() ConfigOpt {
+	return func(c *Config) {
+		c.requireTLS = true
+	}
+}
+
+// WithPassword sets the password of StandardAuth connections, keeping it out
+// of the connection string and thus out of logs and error messages of
+// the parsed connection string. It is set before every connection and takes
+// precedence over a password in the connection string and over the passfile
+// (.pgpass), which pgx only reads when the connection string has no password.
+// It cannot be used with other auth methods, whose auth token is the password.
+func WithPassword(password string) ConfigOpt {
+	return func(c *Config) {
+		c.password = password
+	}
+}
+
+// WithConnectUser sets the database user to connect as, overriding the user
+// of the connection string. It can be used with every auth method, e.g. to
+// log in as the IAM database user matching the identity of a GCP service
+// account or Azure managed identity. Users issued along with the auth token,
+// like those of Vault dynamic credentials, take precedence.
+func WithConnectUser(user string) ConfigOpt {
+	return func(c *Config) {
+		c.resetTokenCache()
+		c.connectUser = user
+	}
+}
+
+// WithUserAgent sets the user agent identifying the requests of the AWS, Azure
+// and GCP SDK clients created by DefaultConfig, so that they can be told apart
+// in cloud provider logs. Where supported it is sent as application ID. It
+// defaults to "go-pgmultiauth/<version>". Clients passed to options like
+// WithAWSAuth are used as they are.
+func WithUserAgent(ua string) ConfigOpt {
+	return func(c *Config) {
+		c.userAgent = ua
+	}
+}
+
+// WithQueryExecMode sets the default query exec mode of connections, e.g.
+// pgx.QueryExecModeSimpleProtocol when connecting through PgBouncer in
+// transaction mode, where prepared statements don't work.
+func WithQueryExecMode(mode pgx.QueryExecMode) ConfigOpt {
+	return func(c *Config) {
+		c.queryExecMode = &mode
+	}
+}
+
+// WithStatementCacheCapacity sets the capacity of the prepared statement
+// cache of connections. A capacity of 0 disables the cache.
+func WithStatementCacheCapacity(n int) ConfigOpt {
+	return func(c *Config) {
+		c.statementCacheCapacity = &n
+	}
+}
+
+// WithDialFunc sets the function used to dial the database, e.g. to connect
+// through a SOCKS proxy or an SSH tunnel. Hosts are passed to dial as they
+// are, without resolving them first, so that they can be resolved on the far
+// side of the proxy. It cannot be used with the Cloud SQL and AlloyDB
+// connectors, which dial the instance themselves.
+func WithDialFunc(dial pgconn.DialFunc) ConfigOpt {
+	return func(c *Config) {
+		c.dialFunc = dial
+	}
+}
+
+// WithTLSConfig sets the TLS config used to connect, e.g. with an in-memory
+// RootCAs pool holding the CA bundle of the provider. It overrides the TLS
+// settings parsed from the connection string for the host and all fallback
+// hosts using TLS, and enables TLS if sslmode disables it. The ServerName is
+// set to the host being connected to unless cfg sets one.
+func WithTLSConfig(cfg *tls.Config) ConfigOpt {
+	return func(c *Config) {
+		c.tlsConfig = cfg
+	}
+}
+
+// WithDirectAuthConnString sets a connection string used instead of the main
+// one to validate the credentials with HealthCheck and ValidateCredentials.
+// This is needed when databases and pools connect through a pooler like
+// PgBouncer, which in auth_query mode caches the credentials it was given, so
+// that a rotated token is checked against the database itself. AWS tokens of
+// such checks are signed for the host of connString.
+func WithDirectAuthConnString(connString string) ConfigOpt {
+	return func(c *Config) {
+		c.directAuthConnString = normalizeConnString(connString)
+		if c.tokens != nil {
+			c.directTokens = &tokenCache{}
+		}
+	}
+}
+
+// directAuthConfig returns the Config used to validate credentials, which
+// connects with the connection string set by WithDirectAuthConnString if any.
+// Its tokens are cached apart from those of the main connection string, as
+// AWS tokens are signed for the host connected to.
+func (c Config) directAuthConfig() Config {
+	if c.directAuthConnString == "" {
+		return c
+	}
+
+	direct := c
+	direct.connString = c.directAuthConnString
+	direct.connConfig = nil
+	direct.connURL = nil
+	direct.directAuthConnString = ""
+	direct.tokens = c.directTokens
+	direct.directTokens = nil
+
+	return direct
+}
+
+// WithTLSServerName sets the server name sent with SNI and verified against
+// the server certificate, instead of the host being connected to. This is
+// needed when connecting to an IP address or through a load balancer whose
+// address isn't in the certificate. It applies to the host and all fallback
+// hosts using TLS, including the TLS config set with WithTLSConfig, and the
+// connection is still dialed to the host of the connection string. It has no
+// effect if sslmode disables TLS.
+func WithTLSServerName(name string) ConfigOpt {
+	return func(c *Config) {
+		c.tlsServerName = name
+	}
+}
+
+// WithAWSAuth sets the AWS configuration for the database connection. Tokens
+// are signed for the host and port of the connection string, or the endpoint
+// set with WithAWSTokenEndpoint. They can't be signed for the host dialed by
+// pgx: it sets the password once and sends it to every fallback host of a
+// multi-host connection string, and IAM rejects tokens signed for another
+// endpoint. Connection strings with several hosts are therefore rejected
+// unless WithAWSTokenEndpoint is set. To use both the writer and the reader
+// endpoint of an Aurora cluster, create a Config and pool per endpoint.
 func WithAWSAuth(cfg *aws.Config) ConfigOpt {
 	return func(c *Config) {
+		c.resetTokenCache()
 		c.authMethod = AWSAuth
 		c.awsConfig = cfg
 	}
 }
 
-// WithazureCreds sets the Azure credentials for the database connection.
-func WithAzureAuth(creds azcore.TokenCredential) ConfigOpt {
-	return func(c *Config) {
-		c.authMethod = AzureAuth
-		c.azureCreds = creds
+// WithAWSCredentialsProvider enables AWS authentication with the given region
+// and credentials provider, without loading the default AWS config. Providers
+// that aren't cached already are wrapped in an aws.CredentialsCache.
+func WithAWSCredentialsProvider(region string, provider aws.CredentialsProvider) ConfigOpt {
+	if _, cached := provider.(*aws.CredentialsCache); !cached && provider != nil {
+		provider = aws.NewCredentialsCache(provider)
+	}
+
+	return WithAWSAuth(&aws.Config{
+		Region:      region,
+		Credentials: provider,
+	})
+}
+
+// WithAWSUser sets the database user the AWS auth token is generated for and
+// connects as, overriding the user of the connection string. The user must
+// be the Postgres role mapped to the IAM identity.
+func WithAWSUser(user string) ConfigOpt {
+	return func(c *Config) {
+		c.resetTokenCache()
+		c.awsUser = user
+	}
+}
+
+// WithAWSTokenEndpoint sets the RDS endpoint the AWS auth token is signed for,
+// overriding the host and port of the connection string. This is needed when
+// connecting through a DNS alias, a proxy or a Unix domain socket whose address
+// differs from the RDS endpoint. Tokens for RDS Proxy are signed for the proxy
+// endpoint, which is the host of the connection string when connecting to the
+// proxy directly. The connection is still made to the host of the connection
+// string.
+// A zero port keeps the port of the connection string.
+func WithAWSTokenEndpoint(host string, port uint16) ConfigOpt {
+	return func(c *Config) {
+		c.resetTokenCache()
+		c.awsTokenHost = host
+		c.awsTokenPort = port
+	}
+}
+
+// WithAzureAuth sets the Azure credentials for the database connection.
+func WithAzureAuth(creds azcore.TokenCredential) ConfigOpt {
+	return func(c *Config) {
+		c.resetTokenCache()
+		c.authMethod = AzureAuth
+		c.azureCreds = creds
+	}
+}
+
+// WithAzureScope overrides the scopes of the Azure token used for the database
+// connection. This is needed for sovereign clouds (e.g. Azure US Government or
+// Azure China) where the AAD resource URI differs from the public cloud, or for
+// custom app registrations. All scopes are requested for the same token.
+func WithAzureScope(scopes ...string) ConfigOpt {
+	return func(c *Config) {
+		c.resetTokenCache()
+		c.azureScopes = scopes
+	}
+}
+
+// withAzureCloud sets the cloud of the Azure credentials, which selects the
+// default scope of their tokens.
+func withAzureCloud(cloud AzureCloud) ConfigOpt {
+	return func(c *Config) {
+		c.resetTokenCache()
+		c.azureCloud = cloud
+	}
+}
+
+// WithAzureADUser sets the database user to connect as with Azure
+// authentication, overriding the user of the connection string. Azure Database
+// for PostgreSQL requires the user to be the name of the Microsoft Entra ID
+// principal the token is issued for, e.g. the managed identity name.
+func WithAzureADUser(user string) ConfigOpt {
+	return func(c *Config) {
+		c.resetTokenCache()
+		c.azureADUser = user
+	}
+}
+
+// WithGoogleAuth sets the Google credentials for the database connection.
+// If they identify a service account and neither the connection string nor
+// WithConnectUser sets a user, the database user is derived from it as
+// described by GCPIAMDatabaseUser.
+func WithGoogleAuth(creds *google.Credentials) ConfigOpt {
+	return func(c *Config) {
+		c.resetTokenCache()
+		c.authMethod = GCPAuth
+		c.googleCreds = creds
+	}
+}
+
+// WithGCPCredentialAccessBoundary downscopes the tokens of the Google
+// credentials to the given Credential Access Boundary rules, so that they
+// only grant access to the resources the rules allow. It only applies to GCP
+// authentication.
+func WithGCPCredentialAccessBoundary(rules ...downscope.AccessBoundaryRule) ConfigOpt {
+	return func(c *Config) {
+		c.resetTokenCache()
+		c.gcpAccessBoundary = rules
+	}
+}
+
+// WithGCPIDToken uses ID tokens issued by the Google credentials for audience
+// instead of access tokens, e.g. for proxies in front of the database that
+// authenticate identity tokens. ID tokens can be issued for service account
+// keys and on Google Cloud through the metadata server.
+func WithGCPIDToken(audience string) ConfigOpt {
+	return func(c *Config) {
+		c.resetTokenCache()
+		c.gcpIDTokenAudience = &audience
+	}
+}
+
+// WithVaultClient sets the Vault client and the path of the secret
+// holding the database credentials for the database connection. Renewable
+// leases of dynamic credentials are renewed when the credentials are about to
+// expire, the secret is only read again if renewing the lease fails.
+func WithVaultClient(client *api.Client, secretPath string) ConfigOpt {
+	return func(c *Config) {
+		c.authMethod = VaultAuth
+		c.vaultClient = client
+		c.vaultSecretPath = secretPath
+		c.resetTokenCache()
+		c.vaultLease = &vaultLease{}
+	}
+}
+
+// WithVaultDatabaseRole reads the database credentials of role from the
+// database secrets engine mounted at mount, i.e. from "<mount>/creds/<role>".
+// The response must contain the "username" and "password" of the dynamic
+// database user. The Vault client is set with WithVaultClient, whose secret
+// path is ignored when a database role is set.
+func WithVaultDatabaseRole(mount, role string) ConfigOpt {
+	return func(c *Config) {
+		c.resetTokenCache()
+		c.authMethod = VaultAuth
+		c.vaultDatabaseMount = mount
+		c.vaultDatabaseRole = role
+	}
+}
+
+// WithVaultAppRole logs in to Vault with the AppRole roleID and secretID
+// instead of using the token of the client set with WithVaultClient. The
+// login is made with a clone of the client, which is otherwise left as is,
+// and mount is the path of the AppRole auth method, "approle" if empty. The
+// Vault token is renewed before it expires, and a new one is issued by
+// logging in again once it can no longer be renewed.
+func WithVaultAppRole(roleID, secretID, mount string) ConfigOpt {
+	if mount = strings.Trim(mount, "/"); mount == "" {
+		mount = "approle"
+	}
+
+	return func(c *Config) {
+		c.resetTokenCache()
+		c.authMethod = VaultAuth
+		c.vaultAppRole = &vaultAppRole{roleID: roleID, secretID: secretID, mount: mount}
+	}
+}
+
+// WithVaultKVVersion sets the version of the KV secrets engine holding the
+// secret set with WithVaultClient. KV v2 secrets nest the credentials under
+// "data", their path must include the "data/" segment, e.g.
+// "secret/data/db". The version is detected from the secret by default, set
+// it when other secrets may contain "data" and "metadata" keys.
+func WithVaultKVVersion(version int) ConfigOpt {
+	return func(c *Config) {
+		c.resetTokenCache()
+		c.vaultKVVersion = version
+	}
+}
+
+// WithTokenGenerator uses tokens returned by generate as the database password,
+// bypassing all cloud SDKs. generate returns the token and its expiry, or a
+// zero time if the token doesn't expire. This is useful to plug in other
+// credential sources or to test the connection setup with a static password.
+func WithTokenGenerator(generate func(ctx context.Context) (token string, expiry time.Time, err error)) ConfigOpt {
+	return func(c *Config) {
+		c.resetTokenCache()
+		c.authMethod = CustomAuth
+		c.customTokenFn = generate
+	}
+}
+
+// WithTokenGeneratorOverride generates the tokens of method with gen instead
+// of the built-in generator, e.g. to sign AWS tokens differently. The method
+// is still selected and configured with its own options, e.g. WithAWSAuth,
+// only fetching the tokens is replaced. It is not supported for StandardAuth
+// and the Cloud SQL and AlloyDB connectors, which don't use auth tokens.
+func WithTokenGeneratorOverride(method AuthMethod, gen TokenGenerator) ConfigOpt {
+	return func(c *Config) {
+		c.resetTokenCache()
+		overrides := make(map[AuthMethod]TokenGenerator, len(c.tokenGeneratorOverrides)+1)
+		for m, g := range c.tokenGeneratorOverrides {
+			overrides[m] = g
+		}
+		overrides[method] = gen
+		c.tokenGeneratorOverrides = overrides
+	}
+}
+
+// WithCloudSQLConnector connects through the Cloud SQL Go Connector to the
+// instance with the given connection name ("project:region:instance"). The
+// connector handles TLS and IAM database authentication, so the host,
+// password and sslmode of the connection string are ignored. Application
+// Default Credentials are used unless opts configure other credentials.
+// GetAuthenticatedConnString and FetchToken are not supported in this mode.
+func WithCloudSQLConnector(instanceConnectionName string, opts ...cloudsqlconn.Option) ConfigOpt {
+	return func(c *Config) {
+		c.resetTokenCache()
+		c.authMethod = CloudSQLAuth
+		c.cloudSQLInstance = instanceConnectionName
+		c.cloudSQLOpts = opts
+	}
+}
+
+// WithAlloyDBConnector connects through the AlloyDB Go Connector to the
+// instance with the given URI
+// ("projects/<PROJECT>/locations/<REGION>/clusters/<CLUSTER>/instances/<INSTANCE>").
+// As with WithCloudSQLConnector, the connector handles TLS and IAM database
+// authentication, so the host, password and sslmode of the connection string
+// are ignored and GetAuthenticatedConnString and FetchToken are not supported.
+func WithAlloyDBConnector(instanceURI string, opts ...alloydbconn.Option) ConfigOpt {
+	return func(c *Config) {
+		c.resetTokenCache()
+		c.authMethod = AlloyDBAuth
+		c.alloyDBInstance = instanceURI
+		c.alloyDBOpts = opts
+	}
+}
+
+// NewConfig creates a new Config with the provided connection string
+// and optional configuration options. It sets a null logger
+// if no logger is provided. Surrounding whitespace is removed from the
+// connection string and its URL scheme is lowercased.
+func NewConfig(connString string, opts ...ConfigOpt) Config {
+	cfg := Config{
+		connString: normalizeConnString(connString),
+
+		// Expect logger to be set by the caller via WithLogger().
+		logger: hclog.NewNullLogger(),
+
+		tokenRefreshBuffer: defaultTokenRefreshBuffer,
+		clock:              time.Now,
+
+		retryAttempts: defaultRetryAttempts,
+		retryDelay:    defaultRetryDelay,
+
+		tokens:    &tokenCache{},
+		resources: &resources{},
+	}
+
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	return cfg
+}
+
+// NewConfigFromConnConfig creates a new Config from an already parsed
+// connection config and optional configuration options. Settings that
+// can't be expressed in a connection string, like a custom TLS config or
+// dial function, are preserved. GetAuthenticatedConnString is not supported
+// for such a Config.
+func NewConfigFromConnConfig(connConfig *pgx.ConnConfig, opts ...ConfigOpt) Config {
+	cfg := NewConfig("", opts...)
+	cfg.connConfig = connConfig
+
+	return cfg
+}
+
+// NewConfigFromURL creates a new Config from a connection URL and optional
+// configuration options. Auth tokens are set on a copy of the URL instead of
+// its string form, which avoids escaping issues with passwords containing
+// characters like '%', '/' or '@'.
+func NewConfigFromURL(u *url.URL, opts ...ConfigOpt) Config {
+	copied := *u
+
+	cfg := NewConfig(copied.String(), opts...)
+	cfg.connURL = &copied
+
+	return cfg
+}
+
+// validate checks if the Config has all required fields
+// and returns a *ConfigValidationError if validation fails.
+func (c Config) validate() error {
+	if errs := c.validationErrors(); len(errs) > 0 {
+		return &ConfigValidationError{Err: errs[0]}
+	}
+
+	return nil
+}
+
+// ValidateAll checks the Config like Open and the other functions using it
+// do, but returns every problem found instead of only the first one. The
+// errors match ErrInvalidConfig. It returns nil if the Config is valid.
+func (c Config) ValidateAll() []error {
+	errs := c.validationErrors()
+	for i, err := range errs {
+		errs[i] = &ConfigValidationError{Err: err}
+	}
+
+	return errs
+}
+
+// validationErrors returns all problems of the Config, in the order validate
+// reports them.
+func (c Config) validationErrors() []error {
+	var errs []error
+
+	if c.connConfig == nil {
+		if err := validateConnString(c.connString); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if c.directAuthConnString != "" {
+		if err := validateConnString(c.directAuthConnString); err != nil {
+			errs = append(errs, fmt.Errorf("invalid direct auth connection string: %w", err))
+		}
+	}
+
+	if c.logger == nil {
+		errs = append(errs, fmt.Errorf("logger cannot be nil"))
+	}
+
+	if c.staticTokenExpiry < 0 {
+		errs = append(errs, fmt.Errorf("static token expiry cannot be negative, got %s", c.staticTokenExpiry))
+	} else if c.staticTokenExpiry > 0 && c.staticTokenExpiry <= c.tokenRefreshBuffer {
+		errs = append(errs, fmt.Errorf("static token expiry %s must be longer than the token refresh buffer %s", c.staticTokenExpiry, c.tokenRefreshBuffer))
+	}
+
+	if _, ok := c.runtimeParams[""]; ok {
+		errs = append(errs, fmt.Errorf("runtime param names cannot be empty"))
+	}
+
+	if c.password != "" && c.authMethod != StandardAuth {
+		errs = append(errs, fmt.Errorf("password cannot be used with auth method %s, its auth token is the password", c.authMethod))
+	}
+
+	for _, method := range slices.Sorted(maps.Keys(c.tokenGeneratorOverrides)) {
+		if method == StandardAuth || method == CloudSQLAuth || method == AlloyDBAuth {
+			errs = append(errs, fmt.Errorf("token generator override is not supported for auth method %s, it does not use auth tokens", method))
+		}
+	}
+
+	if c.dialFunc != nil && c.usesConnector() {
+		errs = append(errs, fmt.Errorf("custom dial function cannot be used with auth method %s, the connector dials the instance itself", c.authMethod))
+	}
+
+	// The Cloud SQL and AlloyDB connectors always use TLS
+	if c.requireTLS && !c.usesConnector() {
+		connConfig, err := c.parseConnConfig()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to parse connection string: %w", err))
+		} else if connConfig.TLSConfig == nil {
+			errs = append(errs, fmt.Errorf("TLS is required but disabled by sslmode, use sslmode require, verify-ca or verify-full"))
+		}
+	}
+
+	// Credentials loaded lazily are validated once they are loaded
+	if c.lazyCreds == nil {
+		if err := c.validateAuthMethod(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+// validateAuthMethod validates the settings of the configured auth method.
+func (c Config) validateAuthMethod() error {
+	provider, err := c.provider()
+	if err != nil {
+		return err
+	}
+
+	return provider.validate()
+}
+
+// parseConnConfig returns a copy of the connection config of the Config,
+// parsing the connection string if the Config wasn't created from a parsed
+// connection config.
+func (c Config) parseConnConfig() (*pgx.ConnConfig, error) {
+	if c.connConfig != nil {
+		connConfig := c.connConfig.Copy()
+		c.configureConnConfig(connConfig)
+		return connConfig, nil
+	}
+
+	connConfig, err := pgx.ParseConfig(c.connString)
+	if err != nil {
+		return nil, &ParseError{ConnString: RedactConnString(c.connString), Err: err}
+	}
+	c.configureConnConfig(connConfig)
+
+	return connConfig, nil
+}
+
+// parsePoolConfig returns the pool config for the Config, see parseConnConfig.
+func (c Config) parsePoolConfig() (*pgxpool.Config, error) {
+	if c.connConfig == nil {
+		poolConfig, err := pgxpool.ParseConfig(c.connString)
+		if err != nil {
+			return nil, &ParseError{ConnString: RedactConnString(c.connString), Err: err}
+		}
+		c.configureConnConfig(poolConfig.ConnConfig)
+
+		return poolConfig, nil
+	}
+
+	// Use the pool defaults and replace the connection config
+	poolConfig, err := pgxpool.ParseConfig("")
+	if err != nil {
+		return nil, err
+	}
+	poolConfig.ConnConfig = c.connConfig.Copy()
+	c.configureConnConfig(poolConfig.ConnConfig)
+
+	return poolConfig, nil
+}
+
+// configureConnConfig applies the connection settings of the Config
+// to connConfig.
+func (c Config) configureConnConfig(connConfig *pgx.ConnConfig) {
+	if c.tracer != nil {
+		connConfig.Tracer = c.tracer
+	}
+
+	if c.connectUser != "" {
+		connConfig.User = c.connectUser
+	}
+
+	if c.queryExecMode != nil {
+		connConfig.DefaultQueryExecMode = *c.queryExecMode
+	}
+
+	if c.statementCacheCapacity != nil {
+		connConfig.StatementCacheCapacity = *c.statementCacheCapacity
+	}
+
+	if c.connectTimeout > 0 {
+		connConfig.ConnectTimeout = c.connectTimeout
+	}
+
+	if c.dialFunc != nil {
+		connConfig.DialFunc = c.dialFunc
+		connConfig.LookupFunc = func(_ context.Context, host string) ([]string, error) {
+			return []string{host}, nil
+		}
+	}
+
+	if c.tlsConfig != nil {
+		connConfig.TLSConfig = c.tlsConfigFor(connConfig.Host)
+		for _, fallback := range connConfig.Fallbacks {
+			if fallback.TLSConfig != nil {
+				fallback.TLSConfig = c.tlsConfigFor(fallback.Host)
+			}
+		}
+	}
+
+	if c.tlsServerName != "" {
+		connConfig.TLSConfig = withServerName(connConfig.TLSConfig, c.tlsServerName)
+		for _, fallback := range connConfig.Fallbacks {
+			fallback.TLSConfig = withServerName(fallback.TLSConfig, c.tlsServerName)
+		}
+	}
+
+	if c.applicationName != "" {
+		if connConfig.RuntimeParams == nil {
+			connConfig.RuntimeParams = make(map[string]string)
+		}
+
+		if _, set := connConfig.RuntimeParams["application_name"]; !set || c.overrideApplicationName {
+			connConfig.RuntimeParams["application_name"] = c.applicationName
+		}
+	}
+
+	if len(c.runtimeParams) > 0 {
+		if connConfig.RuntimeParams == nil {
+			connConfig.RuntimeParams = make(map[string]string, len(c.runtimeParams))
+		}
+
+		for name, value := range c.runtimeParams {
+			if _, set := connConfig.RuntimeParams[name]; !set {
+				connConfig.RuntimeParams[name] = value
+			}
+		}
+	}
+
+	if c.requireTLS {
+		// drop the plaintext fallbacks of sslmode prefer
+		fallbacks := connConfig.Fallbacks[:0:0]
+		for _, fallback := range connConfig.Fallbacks {
+			if fallback.TLSConfig != nil {
+				fallbacks = append(fallbacks, fallback)
+			}
+		}
+		connConfig.Fallbacks = fallbacks
+	}
+}
+
+// tlsConfigFor returns a copy of the TLS config of the Config for connecting
+// to host.
+func (c Config) tlsConfigFor(host string) *tls.Config {
+	cfg := c.tlsConfig.Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+
+	return cfg
+}
+
+// withServerName returns a copy of cfg verifying serverName, or nil if cfg
+// is nil because TLS is disabled.
+func withServerName(cfg *tls.Config, serverName string) *tls.Config {
+	if cfg == nil {
+		return nil
+	}
+
+	cfg = cfg.Clone()
+	cfg.ServerName = serverName
+	return cfg
+}
+
+// now returns the clock of the Config, falling back to time.Now
+// if none is set.
+func (c Config) now() func() time.Time {
+	if c.clock == nil {
+		return time.Now
+	}
+
+	return c.clock
+}
+
+// logFields returns the structured logging fields describing which database
+// the Config authenticates to and how. It never includes credentials.
+func (c Config) logFields() []interface{} {
+	fields := []interface{}{"auth_method", c.authMethod.String()}
+
+	host, user := "", ""
+	if connConfig, err := c.parseConnConfig(); err == nil {
+		host, user = connConfig.Host, connConfig.User
+	}
+
+	return append(fields, "host", host, "user", user)
+}
+
+// authConfigured checks if an authentication method using auth tokens is
+// configured. The Cloud SQL and AlloyDB connectors authenticate in their
+// dialers instead.
+func (c Config) authConfigured() bool {
+	return c.authMethod != StandardAuth && !c.usesConnector()
+}
+
+// usesConnector checks if connections are established by a Google Cloud
+// connector rather than by dialing the host of the connection string.
+func (c Config) usesConnector() bool {
+	return c.authMethod == CloudSQLAuth || c.authMethod == AlloyDBAuth
+}
+
+// installConnectorDialer installs the dialer of the configured Google Cloud
+// connector in connConfig. It does nothing if no connector is configured.
+func (c Config) installConnectorDialer(ctx context.Context, connConfig *pgx.ConnConfig) error {
+	switch c.authMethod {
+	case CloudSQLAuth:
+		return c.installCloudSQLDialer(ctx, connConfig)
+	case AlloyDBAuth:
+		return c.installAlloyDBDialer(ctx, connConfig)
+	default:
+		return nil
+	}
+}
+
+// Open initializes and returns a *sql.DB database connection
+// using the provided authentication configuration.
+func Open(ctx context.Context, config Config) (*sql.DB, error) {
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid auth configuration: %w", err)
+	}
+
+	connConfig, err := config.parseConnConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse database connection string: %w", err)
+	}
+
+	if err := config.installConnectorDialer(ctx, connConfig); err != nil {
+		return nil, err
+	}
+
+	beforeConnect, err := BeforeConnectFn(ctx, config)
+	if err != nil {
+		return nil, fmt.Errorf("generating before connect function: %w", err)
+	}
+
+	db := stdlib.OpenDB(*connConfig, stdlib.OptionBeforeConnect(beforeConnect))
+	return db, nil
+}
+
+// GetConnector initializes and returns a driver.Connector
+// using the provided authentication configuration.
+func GetConnector(ctx context.Context, config Config) (driver.Connector, error) {
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid auth configuration: %w", err)
+	}
+
+	connConfig, err := config.parseConnConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse database connection string: %w", err)
+	}
+
+	if err := config.installConnectorDialer(ctx, connConfig); err != nil {
+		return nil, err
+	}
+
+	beforeConnect, err := BeforeConnectFn(ctx, config)
+	if err != nil {
+		return nil, fmt.Errorf("generating before connect function: %w", err)
+	}
+
+	return stdlib.GetConnector(*connConfig, stdlib.OptionBeforeConnect(beforeConnect)), nil
+}
+
+// NewDBPool initializes and returns a *pgxpool.Pool database connection
+// using the provided authentication configuration.
+func NewDBPool(ctx context.Context, config Config) (*pgxpool.Pool, error) {
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid auth configuration: %w", err)
+	}
+
+	connConfig, err := config.parsePoolConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse database connection string: %w", err)
+	}
+
+	if err := config.installConnectorDialer(ctx, connConfig.ConnConfig); err != nil {
+		return nil, err
+	}
+
+	beforeConnect, err := BeforeConnectFn(ctx, config)
+	if err != nil {
+		return nil, fmt.Errorf("generating before connect function: %w", err)
+	}
+
+	if config.poolConfigFn != nil {
+		config.poolConfigFn(connConfig)
+	}
+
+	connConfig.BeforeConnect = composeBeforeConnect(beforeConnect, connConfig.BeforeConnect)
+
+	if !config.disableAcquirePing {
+		// Check if the connection is still valid before acquiring it
+		connConfig.BeforeAcquire = composeBeforeAcquire(func(ctx context.Context, conn *pgx.Conn) bool {
+			return conn.Ping(ctx) == nil
+		}, connConfig.BeforeAcquire)
+	}
+
+	return pgxpool.NewWithConfig(ctx, connConfig)
+}
+
+// Connect creates a pool like NewDBPool and returns a cleanup function that
+// closes the pool and then stops its background token refresh and releases
+// its Cloud SQL and AlloyDB dialers. The pool has its own token cache, it
+// doesn't share tokens with other databases and pools created from config.
+// It is safe to call cleanup more than once, calls after the first do nothing.
+func Connect(ctx context.Context, config Config) (*pgxpool.Pool, func(), error) {
+	// The pool's resources are released by cleanup instead of config.Close
+	config.tokens = &tokenCache{}
+	config.resources = &resources{}
+
+	pool, err := NewDBPool(ctx, config)
+	if err != nil {
+		_ = config.Close()
+		return nil, nil, err
+	}
+
+	var once sync.Once
+	cleanup := func() {
+		once.Do(func() {
+			pool.Close()
+			if err := config.Close(); err != nil {
+				config.logger.Error("failed to release pool resources", append(config.logFields(), "error", err)...)
+			}
+		})
+	}
+
+	return pool, cleanup, nil
+}
+
+// composeBeforeConnect returns a BeforeConnect hook calling first and then
+// next, if set. It stops at the first error.
+func composeBeforeConnect(first, next func(context.Context, *pgx.ConnConfig) error) func(context.Context, *pgx.ConnConfig) error {
+	if next == nil {
+		return first
+	}
+
+	return func(ctx context.Context, connConfig *pgx.ConnConfig) error {
+		if err := first(ctx, connConfig); err != nil {
+			return err
+		}
+
+		return next(ctx, connConfig)
+	}
+}
+
+// composeBeforeAcquire returns a BeforeAcquire hook calling first and then
+// next, if set. The connection is only acquired if both return true.
+func composeBeforeAcquire(first, next func(context.Context, *pgx.Conn) bool) func(context.Context, *pgx.Conn) bool {
+	if next == nil {
+		return first
+	}
+
+	return func(ctx context.Context, conn *pgx.Conn) bool {
+		return first(ctx, conn) && next(ctx, conn)
+	}
+}
+
+// BeforeConnectFn returns a function that can be used to set up the
+// authentication before establishing a connection to the database.
+// Connectors and pools created from the same Config share one cached token.
+// Fetching the token is bounded by the ConnectTimeout of the connection
+// config, e.g. set by connect_timeout in the connection string.
+// The function set with WithBeforeConnect runs after the token has been set.
+func BeforeConnectFn(ctx context.Context, config Config) (func(context.Context, *pgx.ConnConfig) error, error) {
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid authentication configuration: %w", err)
+	}
+
+	// noop before connect by default
+	beforeConnect := func(context.Context, *pgx.ConnConfig) error { return nil }
+
+	if password := config.password; password != "" {
+		beforeConnect = func(_ context.Context, connConfig *pgx.ConnConfig) error {
+			connConfig.Password = password
+			return nil
+		}
+	}
+
+	if config.authConfigured() {
+		tokens := config.tokenCache()
+		if err := config.initialToken(ctx, tokens); err != nil {
+			return nil, err
+		}
+
+		beforeConnect = func(ctx context.Context, connConfig *pgx.ConnConfig) error {
+			// pgx only applies connect_timeout once BeforeConnect returns
+			if connConfig.ConnectTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, connConfig.ConnectTimeout)
+				defer cancel()
+			}
+
+			token, err := tokens.get(ctx, config)
+			if err != nil {
+				if connConfig.ConnectTimeout > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					return fmt.Errorf("failed to get db token within connect timeout of %s: %w", connConfig.ConnectTimeout, err)
+				}
+
+				return fmt.Errorf("failed to get db token: %w", err)
+			}
+
+			token.apply(connConfig)
+			return nil
+		}
+
+		if config.backgroundRefreshCtx != nil {
+			tokens.backgroundRefresh.Do(func() {
+				config.resources.run(config.backgroundRefreshCtx, func(ctx context.Context) {
+					refreshTokenInBackground(ctx, config, tokens)
+				})
+			})
+		}
+	}
+
+	return composeBeforeConnect(beforeConnect, config.beforeConnectFn), nil
+}
+
+// initialToken fetches the first token into tokens, within the connect
+// timeout if one is configured.
+func (c Config) initialToken(ctx context.Context, tokens *tokenCache) error {
+	if c.connectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.connectTimeout)
+		defer cancel()
+	}
+
+	if _, err := tokens.get(ctx, c); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("failed to get initial db token within connect timeout of %s: %w", c.connectTimeout, err)
+		}
+
+		return fmt.Errorf("failed to get initial db token: %w", err)
+	}
+
+	return nil
+}
+
+// backgroundRefreshRetryInterval is how long the background refresh waits
+// before trying again after failing to refresh the token.
+const backgroundRefreshRetryInterval = 5 * time.Second
+
+// refreshTokenInBackground refreshes token one refresh buffer before it
+// becomes invalid, so that new connections do not have to wait for a token
+// fetch. It returns when ctx is cancelled or the token does not expire.
+func refreshTokenInBackground(ctx context.Context, config Config, tokens *tokenCache) {
+	for {
+		current := tokens.token.Load()
+		if current == nil || current.expiresAt.IsZero() {
+			return
+		}
+
+		// the token becomes invalid one refresh buffer before it expires
+		wait := current.expiresAt.Sub(config.now()()) - 2*config.tokenRefreshBuffer
+		if wait <= 0 {
+			// the auth method returned a token that is about to expire,
+			// don't spin on it
+			wait = backgroundRefreshRetryInterval
+		}
+
+		if !sleepCtx(ctx, wait) {
+			return
+		}
+
+		tokens.mu.Lock()
+		config.logger.Debug("refreshing db token in background", config.logFields()...)
+		refreshed, err := getAuthTokenWithRetry(ctx, config)
+		if err == nil {
+			tokens.token.Store(refreshed)
+		}
+		tokens.mu.Unlock()
+
+		if err != nil {
+			config.logger.Error("failed to refresh db token in background", append(config.logFields(), "error", err)...)
+
+			if !sleepCtx(ctx, backgroundRefreshRetryInterval) {
+				return
+			}
+			continue
+		}
+
+		config.notifyTokenRefresh(refreshed)
+	}
+}
+
+// sleepCtx waits for d to pass. It returns false if ctx is done first.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// GetAuthenticatedConnString returns the database connection string based on the provided
+// authentication configuration. It returns the original connection string if no authentication
+// method is configured, with the password set by WithPassword if any.
+func GetAuthenticatedConnString(ctx context.Context, config Config) (string, error) {
+	if err := config.validate(); err != nil {
+		return "", fmt.Errorf("invalid authentication configuration: %w", err)
+	}
+
+	if config.connString == "" {
+		return "", fmt.Errorf("no connection string available, the config was created from a pgx.ConnConfig")
+	}
+
+	switch config.authMethod {
+	case CloudSQLAuth:
+		return "", fmt.Errorf("authenticated connection strings are not supported with the Cloud SQL connector")
+	case AlloyDBAuth:
+		return "", fmt.Errorf("authenticated connection strings are not supported with the AlloyDB connector")
+	}
+
+	if !config.authConfigured() {
+		if config.connURL != nil {
+			u := config.connURL
+			if config.password != "" {
+				u = withURLPassword(u, config.password)
+			}
+			if config.connectUser != "" {
+				u = withURLUser(u, config.connectUser)
+			}
+
+			return u.String(), nil
+		}
+
+		connString := config.connString
+
+		if config.password != "" {
+			var err error
+			connString, err = replaceDBPassword(connString, config.password)
+			if err != nil {
+				return "", fmt.Errorf("preparing database connection string with password: %w", err)
+			}
+		}
+
+		if config.connectUser != "" {
+			var err error
+			connString, err = replaceDBUser(connString, config.connectUser)
+			if err != nil {
+				return "", fmt.Errorf("preparing database connection string with connect user: %w", err)
+			}
+		}
+
+		return connString, nil
+	}
+
+	token, err := getAuthTokenWithRetry(ctx, config)
+	if err != nil {
+		return "", fmt.Errorf("fetching auth token: %w", err)
+	}
+	config.notifyTokenRefresh(token)
+
+	config.logger.Debug("db auth token fetched", config.logFields()...)
+
+	// A user issued along with the token takes precedence over the connect user
+	user := token.username
+	if user == "" {
+		user = config.connectUser
+	}
+
+	if config.connURL != nil {
+		u := withURLPassword(config.connURL, token.token)
+		if user != "" {
+			u = withURLUser(u, user)
+		}
+
+		return u.String(), nil
+	}
+
+	connString, err := replaceDBPassword(config.connString, token.token)
+	if err != nil {
+		return "", fmt.Errorf("preparing database connection string with auth token: %w", err)
+	}
+
+	if user != "" {
+		connString, err = replaceDBUser(connString, user)
+		if err != nil {
+			return "", fmt.Errorf("preparing database connection string with auth username: %w", err)
+		}
+	}
+
+	return connString, nil
+}
+
+// GetAuthenticatedConnConfig returns the parsed connection config with the auth
+// token set as password, and the user set if the auth method issues one. Unlike
+// GetAuthenticatedConnString it keeps settings that can't be expressed in a
+// connection string and avoids escaping the token. It returns the parsed
+// connection config unchanged if no authentication method is configured,
+// except for the password set by WithPassword.
+func GetAuthenticatedConnConfig(ctx context.Context, config Config) (*pgx.ConnConfig, error) {
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid authentication configuration: %w", err)
+	}
+
+	connConfig, err := config.parseConnConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse database connection string: %w", err)
+	}
+
+	if err := config.installConnectorDialer(ctx, connConfig); err != nil {
+		return nil, err
+	}
+
+	if !config.authConfigured() {
+		if config.password != "" {
+			connConfig.Password = config.password
+		}
+
+		return connConfig, nil
+	}
+
+	token, err := getAuthTokenWithRetry(ctx, config)
+	if err != nil {
+		return nil, fmt.Errorf("fetching auth token: %w", err)
+	}
+	config.notifyTokenRefresh(token)
+
+	config.logger.Debug("db auth token fetched", config.logFields()...)
+	token.apply(connConfig)
+
+	return connConfig, nil
+}
+
+// notifyTokenRefresh passes a newly fetched token to the callback set with
+// WithTokenRefreshCallback. It must not be called while holding a token lock.
+func (c Config) notifyTokenRefresh(token *authToken) {
+	if c.tokenRefreshFn != nil {
+		c.tokenRefreshFn(token.token, token.expiresAt)
 	}
 }
 
-// WithGoogleCreds sets the Google credentials for the database connection.
-func WithGoogleAuth(creds *google.Credentials) ConfigOpt {
-	return func(c *Config) {
-		c.authMethod = GCPAuth
-		c.googleCreds = creds
+// getAuthTokenWithRetry attempts to fetch an authentication token
+// with retries in case of failure. It uses exponential backoff
+// for retrying the request.
+func getAuthTokenWithRetry(ctx context.Context, config Config) (*authToken, error) {
+	ctx = ensureRequestID(ctx)
+
+	var token *authToken
+	var err error
+
+	// retry.Attempts(0) retries until success, never do that
+	attempts := config.retryAttempts
+	if attempts == 0 {
+		attempts = defaultRetryAttempts
 	}
-}
 
-// NewConfig creates a new Config with the provided connection string
-// and optional configuration options. It sets a null logger
-// if no logger is provided.
-func NewConfig(connString string, opts ...ConfigOpt) Config {
-	cfg := Config{
-		connString: connString,
+	// whether the credentials were reloaded after the last failed attempt
+	reloaded := false
+	var attempt uint
 
-		// Expect logger to be set by the caller via WithLogger().
-		logger: hclog.NewNullLogger(),
+	opts := []retry.Option{
+		// stop retrying as soon as the caller gives up
+		retry.Context(ctx),
+		retry.Attempts(attempts),
+		retry.Delay(config.retryDelay),
+		retry.DelayType(retry.BackOffDelay),
+		// don't retry credential and permission errors, unless the credentials were reloaded
+		retry.RetryIf(func(err error) bool { return reloaded || !isPermanentTokenError(err) }),
+		retry.OnRetry(func(n uint, err error) {
+			config.logger.Error("failed to fetch auth token", append(config.fetchLogFields(ctx), "attempt", n, "error", err)...)
+		}),
+	}
+	if config.retryMaxDelay > 0 {
+		opts = append(opts, retry.MaxDelay(config.retryMaxDelay))
 	}
 
-	for _, opt := range opts {
-		opt(&cfg)
+	err = retry.Do(
+		func() error {
+			attemptCtx := ctx
+			if config.tokenFetchTimeout > 0 {
+				var cancel context.CancelFunc
+				attemptCtx, cancel = context.WithTimeout(ctx, config.tokenFetchTimeout)
+				defer cancel()
+			}
+
+			if config.logger.IsDebug() {
+				config.logger.Debug("fetching db auth token", config.fetchLogFields(ctx)...)
+			}
+
+			start := time.Now()
+			token, err = getAuthToken(attemptCtx, config)
+			if config.metricsHook != nil {
+				config.metricsHook.OnTokenFetch(config.authMethod, time.Since(start), err)
+			}
+			if config.logger.IsDebug() {
+				config.logger.Debug("db auth token fetch finished", tokenFetchLogFields(ctx, config, token, time.Since(start), err)...)
+			}
+
+			// only reload for credential errors another attempt retries
+			attempt++
+			reloaded = false
+			if err != nil && config.credentialReloader != nil && attempt < attempts && ctx.Err() == nil && isPermanentTokenError(err) {
+				if reloadErr := config.credentialReloader(ctx); reloadErr != nil {
+					config.logger.Error("failed to reload credentials", append(config.fetchLogFields(ctx), "error", reloadErr)...)
+				} else {
+					reloaded = true
+				}
+			}
+
+			return err
+		},
+		opts...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrTokenFetch, err)
 	}
 
-	return cfg
+	return token, nil
 }
 
-// validate checks if the Config has all required fields
-// and returns an error if validation fails.
-func (c Config) validate() error {
-	if c.connString == "" {
-		return fmt.Errorf("connString cannot be empty")
+// tokenFetchLogFields returns the logging fields describing a token fetch
+// using ctx which took duration. They never include the token itself.
+func tokenFetchLogFields(ctx context.Context, config Config, token *authToken, duration time.Duration, err error) []interface{} {
+	fields := append(config.fetchLogFields(ctx), "duration", duration)
+	if err != nil {
+		return append(fields, "error", err)
 	}
 
-	if c.logger == nil {
-		return fmt.Errorf("logger cannot be nil")
+	if token.expiresAt.IsZero() {
+		return append(fields, "expires_at", "never")
 	}
 
-	// Validate auth-specific configurations
-	switch c.authMethod {
-	case StandardAuth:
-		// No additional validation needed for StandardAuth
-	case AWSAuth:
-		if err := validateAWSConfig(c.awsConfig); err != nil {
-			return fmt.Errorf("invalid AWS config: %v", err)
-		}
-	case AzureAuth:
-		if err := validateAzureConfig(c.azureCreds); err != nil {
-			return fmt.Errorf("invalid Azure config: %v", err)
-		}
-	case GCPAuth:
-		if err := validateGCPConfig(c.googleCreds); err != nil {
-			return fmt.Errorf("invalid GCP config: %v", err)
-		}
-	default:
-		return fmt.Errorf("unsupported authentication method: %d", c.authMethod)
-	}
+	return append(fields, "expires_at", token.expiresAt, "expires_in", token.expiresAt.Sub(config.now()()).Round(time.Second))
+}
 
-	return nil
+type authToken struct {
+	token string
+	valid func() bool
+
+	// username is set by auth methods that issue their own database user
+	// (e.g. Vault dynamic credentials). Empty means the user from the
+	// connection string is used.
+	username string
+
+	// expiresAt is the expiry reported by the auth method. It is zero
+	// for tokens that do not expire.
+	expiresAt time.Time
 }
 
-// authConfigured checks if any authentication method is configured
-func (c Config) authConfigured() bool {
-	return c.authMethod != StandardAuth
+// Token holds the credentials fetched for the configured authentication method.
+type Token struct {
+	// Value is the token used as the database password
+	Value string
+	// Username is the database user issued along with the token, if any
+	Username string
+	// ExpiresAt is when the token expires, zero if it does not expire.
+	// The token is refreshed the configured refresh buffer before ExpiresAt.
+	ExpiresAt time.Time
 }
 
-// Open initializes and returns a *sql.DB database connection
-// using the provided authentication configuration.
-func Open(ctx context.Context, config Config) (*sql.DB, error) {
-	if err := config.validate(); err != nil {
-		return nil, fmt.Errorf("invalid auth configuration: %v", err)
+// FetchToken fetches a token for the configured authentication method. It can be
+// used to preflight credentials or to inspect their expiry without connecting to
+// the database.
+func (c Config) FetchToken(ctx context.Context) (Token, error) {
+	if err := c.validateTokenAuth(); err != nil {
+		return Token{}, err
 	}
 
-	connConfig, err := pgx.ParseConfig(config.connString)
+	token, err := getAuthTokenWithRetry(ctx, c)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse database connection string: %v", err)
+		return Token{}, fmt.Errorf("fetching auth token: %w", err)
 	}
+	c.notifyTokenRefresh(token)
 
-	beforeConnect, err := BeforeConnectFn(ctx, config)
+	return Token{
+		Value:     token.token,
+		Username:  token.username,
+		ExpiresAt: token.expiresAt,
+	}, nil
+}
+
+// GetToken returns the auth token of config and its expiry, for callers that
+// set the password themselves, e.g. in their own BeforeConnect hook. Unlike
+// FetchToken it returns the cached token while it is valid, and it doesn't
+// touch connection strings or pools. The expiry is zero for tokens that don't
+// expire. Use FetchToken for the database user issued by Vault database roles.
+func GetToken(ctx context.Context, config Config) (string, time.Time, error) {
+	if err := config.validateTokenAuth(); err != nil {
+		return "", time.Time{}, err
+	}
+
+	token, err := config.tokenCache().get(ctx, config)
 	if err != nil {
-		return nil, fmt.Errorf("generating before connect function: %v", err)
+		return "", time.Time{}, fmt.Errorf("getting auth token: %w", err)
 	}
 
-	db := stdlib.OpenDB(*connConfig, stdlib.OptionBeforeConnect(beforeConnect))
-	return db, nil
+	return token.token, token.expiresAt, nil
 }
 
-// GetConnector initializes and returns a driver.Connector
-// using the provided authentication configuration.
-func GetConnector(ctx context.Context, config Config) (driver.Connector, error) {
-	if err := config.validate(); err != nil {
-		return nil, fmt.Errorf("invalid auth configuration: %v", err)
+// validateTokenAuth validates the Config and checks that its auth method uses
+// auth tokens.
+func (c Config) validateTokenAuth() error {
+	if err := c.validate(); err != nil {
+		return fmt.Errorf("invalid authentication configuration: %w", err)
 	}
 
-	connConfig, err := pgx.ParseConfig(config.connString)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse database connection string: %v", err)
+	switch c.authMethod {
+	case CloudSQLAuth:
+		return fmt.Errorf("the Cloud SQL connector does not use auth tokens")
+	case AlloyDBAuth:
+		return fmt.Errorf("the AlloyDB connector does not use auth tokens")
 	}
 
-	beforeConnect, err := BeforeConnectFn(ctx, config)
-	if err != nil {
-		return nil, fmt.Errorf("generating before connect function: %v", err)
+	if !c.authConfigured() {
+		return fmt.Errorf("no authentication method configured")
 	}
 
-	return stdlib.GetConnector(*connConfig, stdlib.OptionBeforeConnect(beforeConnect)), nil
+	return nil
 }
 
-// NewDBPool initializes and returns a *pgxpool.Pool database connection
-// using the provided authentication configuration.
-func NewDBPool(ctx context.Context, config Config) (*pgxpool.Pool, error) {
-	if err := config.validate(); err != nil {
-		return nil, fmt.Errorf("invalid auth configuration: %v", err)
+// maxConcurrentTokenFetches bounds the token fetches FetchTokens runs at once.
+const maxConcurrentTokenFetches = 8
+
+// FetchTokens fetches the tokens of configs concurrently, like FetchToken,
+// e.g. to fetch the tokens of many databases at startup. At most
+// maxConcurrentTokenFetches tokens are fetched at once. The tokens are
+// returned in the order of configs, failed fetches leave a zero Token, and
+// the errors of all failed fetches are joined into the returned error.
+func FetchTokens(ctx context.Context, configs []Config) ([]Token, error) {
+	tokens := make([]Token, len(configs))
+	errs := make([]error, len(configs))
+
+	sem := make(chan struct{}, maxConcurrentTokenFetches)
+	var wg sync.WaitGroup
+	for i, config := range configs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			token, err := config.FetchToken(ctx)
+			if err != nil {
+				errs[i] = fmt.Errorf("config %d (%s): %w", i, config.authMethod, err)
+				return
+			}
+			tokens[i] = token
+		}()
 	}
+	wg.Wait()
 
-	connConfig, err := pgxpool.ParseConfig(config.connString)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse database connection string: %v", err)
-	}
+	return tokens, errors.Join(errs...)
+}
 
-	beforeConnect, err := BeforeConnectFn(ctx, config)
-	if err != nil {
-		return nil, fmt.Errorf("generating before connect function: %v", err)
+// ValidateCredentials fetches a token once, without retries, to check that the
+// configured credentials work, e.g. that the identity endpoint is reachable and
+// the identity is allowed to connect. It does not connect to the database and
+// returns nil if no token based authentication method is configured. The token
+// is fetched for the connection string set by WithDirectAuthConnString if any.
+func (c Config) ValidateCredentials(ctx context.Context) error {
+	if err := c.validate(); err != nil {
+		return fmt.Errorf("invalid authentication configuration: %w", err)
 	}
+	c = c.directAuthConfig()
 
-	connConfig.BeforeConnect = beforeConnect
+	if !c.authConfigured() {
+		return nil
+	}
 
-	// Check if the connection is still valid before acquiring it
-	connConfig.BeforeAcquire = func(ctx context.Context, conn *pgx.Conn) bool {
-		return conn.Ping(ctx) == nil
+	if _, err := getAuthToken(ctx, c); err != nil {
+		return fmt.Errorf("validating credentials: %w: %w", ErrTokenFetch, err)
 	}
 
-	return pgxpool.NewWithConfig(ctx, connConfig)
+	return nil
 }
 
-// BeforeConnectFn returns a function that can be used to set up the
-// authentication before establishing a connection to the database.
-func BeforeConnectFn(ctx context.Context, config Config) (func(context.Context, *pgx.ConnConfig) error, error) {
-	if err := config.validate(); err != nil {
-		return nil, fmt.Errorf("invalid authentication configuration: %v", err)
-	}
+// validBefore returns a validity check for a token expiring at expiry which
+// reports the token as invalid refreshBuffer before it actually expires.
+func validBefore(clock func() time.Time, expiry time.Time, refreshBuffer time.Duration) func() bool {
+	refreshAt := expiry.Add(-refreshBuffer)
+	return func() bool { return clock().Before(refreshAt) }
+}
 
-	// noop before connect by default
-	beforeConnect := func(context.Context, *pgx.ConnConfig) error { return nil }
+// apply sets the credentials carried by the token on connConfig.
+func (t *authToken) apply(connConfig *pgx.ConnConfig) {
+	connConfig.Password = t.token
+	if t.username != "" {
+		connConfig.User = t.username
+	}
+}
 
-	if config.authConfigured() {
-		config.logger.Info("getting initial db auth token")
-		token, err := getAuthTokenWithRetry(ctx, config)
-		if err != nil {
-			return nil, fmt.Errorf("failed to get initial db token: %v", err)
-		}
+// tokenGenerator is an interface that defines a method for generating
+// authentication tokens. This allows for different implementations
+// for different authentication methods (AWS, GCP, Azure, Vault).
+type tokenGenerator interface {
+	generateToken(context.Context) (*authToken, error)
+}
 
-		var tokenMutex sync.Mutex
+// TokenGenerator generates the auth tokens of an authentication method,
+// see WithTokenGeneratorOverride.
+type TokenGenerator interface {
+	// GenerateToken returns a new token. A token with a zero ExpiresAt
+	// never expires, else it is refreshed the refresh buffer before.
+	GenerateToken(ctx context.Context) (Token, error)
+}
 
-		beforeConnect = func(ctx context.Context, connConfig *pgx.ConnConfig) error {
-			// no point in contending for lock if we know the token is valid
-			if token.valid() {
-				connConfig.Password = token.token
-				return nil
+// awsTokenEndpoint returns the endpoint AWS auth tokens are signed for. It is
+// the host of the connection string, unless it is overridden with
+// WithAWSTokenEndpoint.
+func (c Config) awsTokenEndpoint() (string, uint16, error) {
+	connConfig, err := c.parseConnConfig()
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to parse connection string: %w", err)
+	}
+	host, port := connConfig.Host, connConfig.Port
+
+	// pgx fails over to the other hosts with the password set for the first,
+	// which IAM rejects as the token is signed for a single endpoint
+	if c.awsTokenHost == "" {
+		for _, fallback := range connConfig.Fallbacks {
+			if fallback.Host != host || fallback.Port != port {
+				return "", 0, fmt.Errorf("%w, connection string has hosts %q and %q, connect to a single host or set the endpoint with WithAWSTokenEndpoint",
+					errAWSMultiHost, fmt.Sprintf("%s:%d", host, port), fmt.Sprintf("%s:%d", fallback.Host, fallback.Port))
 			}
+		}
+	}
 
-			// acquire lock if token is not valid
-			tokenMutex.Lock()
-			defer tokenMutex.Unlock()
-
-			// necessary because multiple connections in the pool might be waiting to acquire tokenMutex after finding the token invalid
-			// and the token might have been refreshed by a connection that acquired the lock first
-			if !token.valid() {
-				config.logger.Info("refreshing db token")
-				token, err = getAuthTokenWithRetry(ctx, config)
-				if err != nil {
-					return fmt.Errorf("failed to get db token: %v", err)
-				}
-			}
+	if c.awsTokenHost != "" {
+		host = c.awsTokenHost
+	}
+	if c.awsTokenPort != 0 {
+		port = c.awsTokenPort
+	}
 
-			connConfig.Password = token.token
-			return nil
-		}
+	// Tokens are signed for the RDS endpoint, which a local socket path isn't
+	if isUnixSocketHost(host) {
+		return "", 0, fmt.Errorf("%w, %q is a Unix domain socket, set the RDS endpoint with WithAWSTokenEndpoint", errAWSSocketHost, host)
 	}
 
-	return beforeConnect, nil
+	return host, port, nil
 }
 
-// GetAuthenticatedConnString returns the database connection string based on the provided
-// authentication configuration. It returns the original connection string if no authentication
-// method is configured.
-func GetAuthenticatedConnString(ctx context.Context, config Config) (string, error) {
-	if err := config.validate(); err != nil {
-		return "", fmt.Errorf("invalid authentication configuration: %v", err)
+// getAuthToken returns an authentication token for the database connection
+// based on the provided authentication configuration.
+func getAuthToken(ctx context.Context, config Config) (*authToken, error) {
+	if config.lazyCreds != nil {
+		resolved, err := config.lazyCreds.resolve(ctx, config)
+		if err != nil {
+			return nil, fmt.Errorf("loading credentials: %w", err)
+		}
+		config = resolved
 	}
 
-	if !config.authConfigured() {
-		return config.connString, nil
+	var generator tokenGenerator
+	if override, ok := config.tokenGeneratorOverrides[config.authMethod]; ok {
+		generator = overrideTokenConfig{
+			gen:           override,
+			refreshBuffer: config.tokenRefreshBuffer,
+			clock:         config.now(),
+		}
+	} else {
+		provider, err := config.provider()
+		if err != nil {
+			return nil, err
+		}
+		generator = provider
 	}
 
-	token, err := getAuthTokenWithRetry(ctx, config)
+	token, err := generator.generateToken(ctx)
 	if err != nil {
-		return "", fmt.Errorf("fetching auth token: %v", err)
+		return nil, err
 	}
 
-	config.logger.Info("db auth token fetched")
-
-	connString, err := replaceDBPassword(config.connString, token.token)
-	if err != nil {
-		return "", fmt.Errorf("preparing database connection string with auth token: %v", err)
+	if config.staticTokenExpiry > 0 {
+		clock := config.now()
+		token.expiresAt = clock().Add(config.staticTokenExpiry)
+		token.valid = validBefore(clock, token.expiresAt, config.tokenRefreshBuffer)
 	}
 
-	return connString, nil
+	return token, nil
 }
 
-// getAuthTokenWithRetry attempts to fetch an authentication token
-// with retries in case of failure. It uses exponential backoff
-// for retrying the request.
-func getAuthTokenWithRetry(ctx context.Context, config Config) (*authToken, error) {
-	var token *authToken
-	var err error
+// redactedPassword replaces passwords in redacted connection strings.
+const redactedPassword = "xxxxx"
 
-	err = retry.Do(
-		func() error {
-			token, err = getAuthToken(ctx, config)
-			return err
-		},
-		retry.Attempts(3),
-		retry.Delay(50*time.Millisecond),
-		retry.DelayType(retry.BackOffDelay),
-		retry.OnRetry(func(n uint, err error) {
-			config.logger.Error("failed to fetch auth token", "attempt", n, "error", err)
-		}),
-	)
-	if err != nil {
-		return nil, fmt.Errorf("fetching auth token: %v", err)
+// RedactConnString returns connString with its password replaced by "xxxxx"
+// so that it can be logged safely. Everything else is kept as is. Connection
+// URLs that can't be parsed are redacted completely.
+func RedactConnString(connString string) string {
+	if isConnURL(connString) {
+		return redactConnStringURL(connString)
 	}
 
-	return token, nil
+	return redactConnStringDSN(connString)
 }
 
-type authToken struct {
-	token string
-	valid func() bool
-}
+func redactConnStringURL(databaseURL string) string {
+	u, err := url.Parse(databaseURL)
+	if err != nil {
+		return redactedPassword
+	}
 
-// tokenGenerator is an interface that defines a method for generating
-// authentication tokens. This allows for different implementations
-// for different authentication methods (AWS, GCP, Azure).
-type tokenGenerator interface {
-	generateToken(context.Context) (*authToken, error)
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redactedPassword)
+	}
+
+	u.RawQuery = redactQueryParam(u.RawQuery, "password")
+
+	return u.String()
 }
 
-// getAuthToken returns an authentication token for the database connection
-// based on the provided authentication configuration.
-func getAuthToken(ctx context.Context, config Config) (*authToken, error) {
-	var tokenGenerator tokenGenerator
+func redactConnStringDSN(connStr string) string {
+	settings := splitDSN(connStr)
+	result := make([]string, 0, len(settings))
 
-	switch {
-	case config.authMethod == AWSAuth:
-		connConfig, err := pgx.ParseConfig(config.connString)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse connection string: %v", err)
+	redacted := false
+	for _, setting := range settings {
+		if setting.key == "password" {
+			result = append(result, "password="+redactedPassword)
+			redacted = true
+		} else {
+			result = append(result, setting.raw)
 		}
+	}
 
-		tokenGenerator = awsTokenConfig{
-			host:      connConfig.Host,
-			port:      connConfig.Port,
-			user:      connConfig.User,
-			awsConfig: config.awsConfig,
-		}
-	case config.authMethod == GCPAuth:
-		tokenGenerator = gcpTokenConfig{
-			creds: config.googleCreds,
-		}
-	case config.authMethod == AzureAuth:
-		tokenGenerator = azureTokenConfig{
-			creds: config.azureCreds,
-		}
-	default:
-		return nil, fmt.Errorf("unsupported authentication method: %d", config.authMethod)
+	if !redacted {
+		return connStr
 	}
 
-	return tokenGenerator.generateToken(ctx)
+	return strings.Join(result, " ")
 }
 
 // replaceDBPassword replaces the password in a PostgreSQL connection String
@@ -367,11 +2011,11 @@ func replaceDBPassword(connString string, newPassword string) (string, error) {
 	newConnString := ""
 
 	// connString may be a database URL or in PostgreSQL keyword/value format
-	if strings.HasPrefix(connString, "postgres://") || strings.HasPrefix(connString, "postgresql://") {
+	if isConnURL(connString) {
 		var err error
 		newConnString, err = replaceDBPasswordURL(connString, newPassword)
 		if err != nil {
-			return "", fmt.Errorf("preparing database connection url with auth token: %v", err)
+			return "", fmt.Errorf("preparing database connection url with auth token: %w", err)
 		}
 	} else {
 		newConnString = replaceDBPasswordDSN(connString, newPassword)
@@ -380,59 +2024,199 @@ func replaceDBPassword(connString string, newPassword string) (string, error) {
 	return newConnString, nil
 }
 
+// replaceDBPasswordURL replaces or adds the password in a PostgreSQL connection URL.
+// The URL is re-encoded by net/url, which handles IPv6 hosts, missing ports,
+// query parameters and fragments.
 func replaceDBPasswordURL(databaseURL, newPassword string) (string, error) {
 	u, err := url.Parse(databaseURL)
 	if err != nil {
 		return "", fmt.Errorf("failed to parse connection URL: %w", err)
 	}
 
-	var username string
-	if u.User != nil {
-		username = u.User.Username()
+	return withURLPassword(u, newPassword).String(), nil
+}
+
+// withURLPassword returns a copy of the connection URL u with its password
+// replaced by newPassword.
+func withURLPassword(u *url.URL, newPassword string) *url.URL {
+	copied := *u
+	copied.User = url.UserPassword(u.User.Username(), newPassword)
+
+	// A password query parameter takes precedence over the userinfo password,
+	// drop it without touching other parameters like sslpassword
+	copied.RawQuery = withoutQueryParam(copied.RawQuery, "password")
+
+	return &copied
+}
+
+// replaceDBPasswordDSN replaces or adds the password in a PostgreSQL DSN (key=value format).
+// It ensures the DSN contains the provided password, replacing any existing password if present.
+// A missing password is added right after the user, so the key order doesn't depend on the token.
+func replaceDBPasswordDSN(connStr, newPassword string) string {
+	return replaceDSNValue(connStr, "password", newPassword, "user")
+}
+
+// replaceDBUser replaces the user in a PostgreSQL connection string.
+// If no user exists in the original string, it adds one.
+func replaceDBUser(connString string, newUser string) (string, error) {
+	newConnString := ""
+
+	// connString may be a database URL or in PostgreSQL keyword/value format
+	if isConnURL(connString) {
+		var err error
+		newConnString, err = replaceDBUserURL(connString, newUser)
+		if err != nil {
+			return "", fmt.Errorf("preparing database connection url with auth username: %w", err)
+		}
+	} else {
+		newConnString = replaceDBUserDSN(connString, newUser)
 	}
 
-	dbURL := fmt.Sprintf("%s://%s:%s@%s%s",
-		u.Scheme,
-		url.QueryEscape(username),
-		url.QueryEscape(newPassword),
-		u.Host,
-		u.Path,
-	)
+	return newConnString, nil
+}
 
-	if u.RawQuery != "" {
-		dbURL = fmt.Sprintf("%s?%s", dbURL, u.RawQuery)
+// replaceDBUserURL replaces or adds the user in a PostgreSQL connection URL,
+// keeping any password that is already present.
+func replaceDBUserURL(databaseURL, newUser string) (string, error) {
+	u, err := url.Parse(databaseURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse connection URL: %w", err)
 	}
 
-	if u.Fragment != "" {
-		dbURL = fmt.Sprintf("%s#%s", dbURL, u.Fragment)
+	return withURLUser(u, newUser).String(), nil
+}
+
+// withURLUser returns a copy of the connection URL u with its user replaced
+// by newUser, keeping any password that is already present.
+func withURLUser(u *url.URL, newUser string) *url.URL {
+	copied := *u
+	if password, ok := u.User.Password(); ok {
+		copied.User = url.UserPassword(newUser, password)
+	} else {
+		copied.User = url.User(newUser)
 	}
 
-	return dbURL, nil
+	return &copied
 }
 
-// replaceDBPasswordDSN replaces or adds the password in a PostgreSQL DSN (key=value format).
-// It ensures the DSN contains the provided password, replacing any existing password if present.
-func replaceDBPasswordDSN(connStr, newPassword string) string {
-	// Split the DSN into components
-	parts := strings.Split(connStr, " ")
-	passwordFound := false
-	result := make([]string, 0, len(parts))
-
-	escapedPassword := strings.ReplaceAll(newPassword, "'", "''")
-
-	for _, part := range parts {
-		// Check if this part contains the password
-		if strings.HasPrefix(part, "password=") {
-			result = append(result, fmt.Sprintf("password='%s'", escapedPassword))
-			passwordFound = true
+// replaceDBUserDSN replaces or adds the user in a PostgreSQL DSN (key=value format).
+func replaceDBUserDSN(connStr, newUser string) string {
+	return replaceDSNValue(connStr, "user", newUser, "")
+}
+
+// replaceDSNValue replaces or adds the value of key in a PostgreSQL DSN (key=value format).
+// All other settings are kept as they are, including their quoting. A missing key is added
+// right after the setting of after if present, else at the end.
+func replaceDSNValue(connStr, key, value, after string) string {
+	settings := splitDSN(connStr)
+	setting := fmt.Sprintf("%s=%s", key, quoteDSNValue(value))
+	keyFound := false
+	afterIndex := -1
+	result := make([]string, 0, len(settings)+1)
+
+	for _, existing := range settings {
+		if existing.key == key {
+			result = append(result, setting)
+			keyFound = true
 		} else {
-			result = append(result, part)
+			result = append(result, existing.raw)
+		}
+
+		if after != "" && existing.key == after {
+			afterIndex = len(result)
 		}
 	}
 
-	if !passwordFound {
-		result = append(result, fmt.Sprintf("password='%s'", escapedPassword))
+	if !keyFound {
+		if afterIndex < 0 {
+			afterIndex = len(result)
+		}
+		result = slices.Insert(result, afterIndex, setting)
 	}
 
 	return strings.Join(result, " ")
 }
+
+// dsnSetting is a single key=value pair of a DSN.
+type dsnSetting struct {
+	key string
+	// raw is the setting as written in the DSN, including any quoting
+	raw string
+}
+
+// splitDSN splits a PostgreSQL DSN into its settings following the libpq rules:
+// settings are separated by whitespace, values may be single-quoted to contain
+// whitespace and backslash escapes the next character.
+func splitDSN(dsn string) []dsnSetting {
+	var settings []dsnSetting
+
+	i := 0
+	for {
+		for i < len(dsn) && isDSNSpace(dsn[i]) {
+			i++
+		}
+		if i >= len(dsn) {
+			break
+		}
+
+		start := i
+		for i < len(dsn) && dsn[i] != '=' && !isDSNSpace(dsn[i]) {
+			i++
+		}
+		key := dsn[start:i]
+
+		// libpq allows whitespace around '='
+		j := i
+		for j < len(dsn) && isDSNSpace(dsn[j]) {
+			j++
+		}
+		if j < len(dsn) && dsn[j] == '=' {
+			i = j + 1
+			for i < len(dsn) && isDSNSpace(dsn[i]) {
+				i++
+			}
+
+			if i < len(dsn) && dsn[i] == '\'' {
+				// quoted value, ends at the first unescaped quote
+				i++
+				for i < len(dsn) && dsn[i] != '\'' {
+					if dsn[i] == '\\' {
+						i++
+					}
+					i++
+				}
+				i++
+			} else {
+				for i < len(dsn) && !isDSNSpace(dsn[i]) {
+					if dsn[i] == '\\' {
+						i++
+					}
+					i++
+				}
+			}
+
+			// an unterminated quote or trailing backslash runs past the end
+			i = min(i, len(dsn))
+		}
+
+		settings = append(settings, dsnSetting{key: key, raw: dsn[start:i]})
+	}
+
+	return settings
+}
+
+func isDSNSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+// quoteDSNValue quotes value for use in a PostgreSQL DSN. Values are only
+// quoted if they are empty or contain whitespace, quotes or backslashes.
+func quoteDSNValue(value string) string {
+	if value != "" && !strings.ContainsAny(value, " \t\n\r\v\f'\\") {
+		return value
+	}
+
+	escaped := strings.ReplaceAll(value, `\`, `\\`)
+	escaped = strings.ReplaceAll(escaped, `'`, `\'`)
+	return "'" + escaped + "'"
+}
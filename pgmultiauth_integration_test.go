@@ -11,6 +11,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/stretchr/testify/require"
 	"github.com/testcontainers/testcontainers-go"
 	"github.com/testcontainers/testcontainers-go/modules/postgres"
@@ -41,13 +42,13 @@ func TestConnectivity(t *testing.T) {
 	}
 
 	authMode := StandardAuth
-	if authMethod == "aws" {
-		authMode = AWSAuth
+	if authMethod != "" {
+		var err error
+		authMode, err = ParseAuthMethod(authMethod)
+		require.NoError(t, err, "invalid AUTH_METHOD")
+	}
+	if authMode == AWSAuth {
 		require.NotEmpty(t, os.Getenv("AWS_REGION"), "AWS_REGION environment variable is not set")
-	} else if authMethod == "gcp" {
-		authMode = GCPAuth
-	} else if authMethod == "azure" {
-		authMode = AzureAuth
 	}
 
 	config, err := DefaultConfig(ctx, connURL, DefaultAuthConfigOptions{
@@ -61,6 +62,251 @@ func TestConnectivity(t *testing.T) {
 	require.NoError(t, err, "Failed to test connectivity. authMethod: %s", authMethod)
 }
 
+// TestCloudSQLConnectorConnectivity connects to a real Cloud SQL instance with
+// IAM database authentication. It requires CLOUDSQL_INSTANCE to be set to the
+// instance connection name and CLOUDSQL_PGURL to a connection string with the
+// IAM database user, e.g. "user=sa@project.iam dbname=postgres".
+func TestCloudSQLConnectorConnectivity(t *testing.T) {
+	instance := os.Getenv("CLOUDSQL_INSTANCE")
+	if instance == "" {
+		t.Skip("CLOUDSQL_INSTANCE is not set")
+	}
+
+	connURL := os.Getenv("CLOUDSQL_PGURL")
+	require.NotEmpty(t, connURL, "CLOUDSQL_INSTANCE is set but CLOUDSQL_PGURL is not set")
+
+	ctx := context.Background()
+	config := NewConfig(connURL, WithCloudSQLConnector(instance))
+
+	require.NoError(t, openTest(ctx, config))
+	require.NoError(t, connectorTest(ctx, config))
+	require.NoError(t, dbPoolTest(ctx, config))
+}
+
+// TestAlloyDBConnectorConnectivity connects to a real AlloyDB instance with
+// IAM database authentication. It requires ALLOYDB_INSTANCE to be set to the
+// instance URI and ALLOYDB_PGURL to a connection string with the IAM database
+// user, e.g. "user=sa@project.iam dbname=postgres".
+func TestAlloyDBConnectorConnectivity(t *testing.T) {
+	instance := os.Getenv("ALLOYDB_INSTANCE")
+	if instance == "" {
+		t.Skip("ALLOYDB_INSTANCE is not set")
+	}
+
+	connURL := os.Getenv("ALLOYDB_PGURL")
+	require.NotEmpty(t, connURL, "ALLOYDB_INSTANCE is set but ALLOYDB_PGURL is not set")
+
+	ctx := context.Background()
+	config := NewConfig(connURL, WithAlloyDBConnector(instance))
+
+	require.NoError(t, openTest(ctx, config))
+	require.NoError(t, connectorTest(ctx, config))
+	require.NoError(t, dbPoolTest(ctx, config))
+}
+
+// TestTokenGeneratorConnectivity connects to a local database using its static
+// password as token of a custom token generator.
+func TestTokenGeneratorConnectivity(t *testing.T) {
+	if os.Getenv("PGURL") != "" {
+		t.Skip("PGURL is set, the test requires the local test database")
+	}
+
+	ctx := context.Background()
+
+	container, err := prepareTestDBContainer(ctx)
+	defer func() {
+		if err := container.Terminate(ctx); err != nil {
+			t.Logf("Failed to terminate container: %v", err)
+		}
+	}()
+	require.NoError(t, err, "container error")
+
+	connURL, err := container.ConnectionString(ctx)
+	require.NoError(t, err, "reading connection string")
+
+	// Drop the password from the connection string, it must come from the generator
+	connURL, err = replaceDBPassword(connURL, "")
+	require.NoError(t, err)
+
+	calls := 0
+	config := NewConfig(connURL, WithTokenGenerator(func(ctx context.Context) (string, time.Time, error) {
+		calls++
+		return "hashicorp", time.Time{}, nil
+	}))
+
+	require.NoError(t, testConnectivity(t, config))
+	require.Positive(t, calls)
+}
+
+// TestSimpleProtocolConnectivity connects to a local database without
+// prepared statements, as required when connecting through PgBouncer in
+// transaction mode.
+func TestSimpleProtocolConnectivity(t *testing.T) {
+	if os.Getenv("PGURL") != "" {
+		t.Skip("PGURL is set, the test requires the local test database")
+	}
+
+	ctx := context.Background()
+
+	container, err := prepareTestDBContainer(ctx)
+	defer func() {
+		if err := container.Terminate(ctx); err != nil {
+			t.Logf("Failed to terminate container: %v", err)
+		}
+	}()
+	require.NoError(t, err, "container error")
+
+	connURL, err := container.ConnectionString(ctx)
+	require.NoError(t, err, "reading connection string")
+
+	config := NewConfig(connURL, WithQueryExecMode(pgx.QueryExecModeSimpleProtocol), WithStatementCacheCapacity(0))
+	require.NoError(t, testConnectivity(t, config))
+
+	pool, err := NewDBPool(ctx, config)
+	require.NoError(t, err)
+	defer pool.Close()
+
+	var sum int
+	require.NoError(t, pool.QueryRow(ctx, "select $1::int + $2::int", 1, 2).Scan(&sum))
+	require.Equal(t, 3, sum)
+
+	// No statements were prepared on the server
+	var prepared int
+	require.NoError(t, pool.QueryRow(ctx, "select count(*) from pg_prepared_statements").Scan(&prepared))
+	require.Zero(t, prepared)
+}
+
+// TestHealthCheck checks a local database before and after it is stopped.
+func TestHealthCheck(t *testing.T) {
+	if os.Getenv("PGURL") != "" {
+		t.Skip("PGURL is set, the test requires the local test database")
+	}
+
+	ctx := context.Background()
+
+	container, err := prepareTestDBContainer(ctx)
+	defer func() {
+		if err := container.Terminate(ctx); err != nil {
+			t.Logf("Failed to terminate container: %v", err)
+		}
+	}()
+	require.NoError(t, err, "container error")
+
+	connURL, err := container.ConnectionString(ctx)
+	require.NoError(t, err, "reading connection string")
+
+	connURL, err = replaceDBPassword(connURL, "")
+	require.NoError(t, err)
+
+	config := NewConfig(connURL, WithTokenGenerator(func(ctx context.Context) (string, time.Time, error) {
+		return "hashicorp", time.Time{}, nil
+	}))
+	require.NoError(t, HealthCheck(ctx, config))
+
+	require.NoError(t, container.Stop(ctx, nil))
+
+	err = HealthCheck(ctx, config)
+	require.ErrorContains(t, err, "health check: connecting to database")
+	require.False(t, IsAuthError(err))
+}
+
+// TestApplicationName checks that connections of a local database report the
+// application name set with WithApplicationName.
+func TestApplicationName(t *testing.T) {
+	if os.Getenv("PGURL") != "" {
+		t.Skip("PGURL is set, the test requires the local test database")
+	}
+
+	ctx := context.Background()
+
+	container, err := prepareTestDBContainer(ctx)
+	defer func() {
+		if err := container.Terminate(ctx); err != nil {
+			t.Logf("Failed to terminate container: %v", err)
+		}
+	}()
+	require.NoError(t, err, "container error")
+
+	connURL, err := container.ConnectionString(ctx)
+	require.NoError(t, err, "reading connection string")
+
+	config := NewConfig(connURL, WithApplicationName("pgmultiauth-test"))
+	const query = "select current_setting('application_name')"
+
+	t.Run("Open", func(t *testing.T) {
+		db, err := Open(ctx, config)
+		require.NoError(t, err)
+		defer db.Close()
+
+		var name string
+		require.NoError(t, db.QueryRowContext(ctx, query).Scan(&name))
+		require.Equal(t, "pgmultiauth-test", name)
+	})
+
+	t.Run("GetConnector", func(t *testing.T) {
+		connector, err := GetConnector(ctx, config)
+		require.NoError(t, err)
+		db := sql.OpenDB(connector)
+		defer db.Close()
+
+		var name string
+		require.NoError(t, db.QueryRowContext(ctx, query).Scan(&name))
+		require.Equal(t, "pgmultiauth-test", name)
+	})
+
+	t.Run("NewDBPool", func(t *testing.T) {
+		pool, err := NewDBPool(ctx, config)
+		require.NoError(t, err)
+		defer pool.Close()
+
+		var name string
+		require.NoError(t, pool.QueryRow(ctx, query).Scan(&name))
+		require.Equal(t, "pgmultiauth-test", name)
+	})
+}
+
+// TestRuntimeParams checks that the settings of connections to a local
+// database are set by WithRuntimeParams.
+func TestRuntimeParams(t *testing.T) {
+	if os.Getenv("PGURL") != "" {
+		t.Skip("PGURL is set, the test requires the local test database")
+	}
+
+	ctx := context.Background()
+
+	container, err := prepareTestDBContainer(ctx)
+	defer func() {
+		if err := container.Terminate(ctx); err != nil {
+			t.Logf("Failed to terminate container: %v", err)
+		}
+	}()
+	require.NoError(t, err, "container error")
+
+	connURL, err := container.ConnectionString(ctx)
+	require.NoError(t, err, "reading connection string")
+
+	config := NewConfig(connURL, WithRuntimeParams(map[string]string{
+		"search_path":       "app",
+		"statement_timeout": "5s",
+	}))
+
+	pool, err := NewDBPool(ctx, config)
+	require.NoError(t, err)
+	defer pool.Close()
+
+	var searchPath, statementTimeout string
+	require.NoError(t, pool.QueryRow(ctx, "select current_setting('search_path'), current_setting('statement_timeout')").Scan(&searchPath, &statementTimeout))
+	require.Equal(t, "app", searchPath)
+	require.Equal(t, "5s", statementTimeout)
+
+	db, err := Open(ctx, config)
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.QueryRowContext(ctx, "select current_setting('search_path')").Scan(&searchPath))
+	require.Equal(t, "app", searchPath)
+}
+
 func testConnectivity(t *testing.T, config Config) error {
 	t.Log("Testing connectivity to the database")
 
@@ -0,0 +1,99 @@
+// Copyright IBM Corp. 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package pgmultiauth
+
+import (
+	"context"
+	"fmt"
+)
+
+// credentialProvider issues the auth tokens of an authentication method and
+// validates the settings it needs to do so.
+type credentialProvider interface {
+	tokenGenerator
+	validate() error
+}
+
+// provider returns the credential provider of the configured auth method. It
+// is built from the options when used rather than by the options themselves,
+// as options like WithAWSUser or WithVaultDatabaseRole may be passed before or
+// after the option selecting the auth method.
+func (c Config) provider() (credentialProvider, error) {
+	switch c.authMethod {
+	case StandardAuth:
+		return standardProvider{}, nil
+	case AWSAuth:
+		return c.awsTokenConfig(), nil
+	case GCPAuth:
+		return gcpTokenConfig{
+			creds:           c.googleCreds,
+			user:            c.gcpUser(),
+			accessBoundary:  c.gcpAccessBoundary,
+			idTokenAudience: c.gcpIDTokenAudience,
+			refreshBuffer:   c.tokenRefreshBuffer,
+			clock:           c.now(),
+		}, nil
+	case AzureAuth:
+		return azureTokenConfig{
+			creds:         c.azureCreds,
+			scopes:        c.azureScopes,
+			cloud:         c.azureCloud,
+			user:          c.azureADUser,
+			refreshBuffer: c.tokenRefreshBuffer,
+			clock:         c.now(),
+		}, nil
+	case VaultAuth:
+		return c.vaultTokenConfig(), nil
+	case CustomAuth:
+		return customTokenConfig{
+			generate:      c.customTokenFn,
+			refreshBuffer: c.tokenRefreshBuffer,
+			clock:         c.now(),
+		}, nil
+	case CloudSQLAuth:
+		return connectorProvider{method: c.authMethod, instance: c.cloudSQLInstance}, nil
+	case AlloyDBAuth:
+		return connectorProvider{method: c.authMethod, instance: c.alloyDBInstance}, nil
+	default:
+		return nil, fmt.Errorf("unsupported authentication method: %d", c.authMethod)
+	}
+}
+
+// standardProvider is the provider of StandardAuth, connections use the
+// password of the connection string.
+type standardProvider struct{}
+
+func (standardProvider) validate() error {
+	return nil
+}
+
+func (standardProvider) generateToken(context.Context) (*authToken, error) {
+	return nil, fmt.Errorf("standard authentication issues no tokens, the password of the connection string is used")
+}
+
+// connectorProvider is the provider of the connector auth methods, whose
+// dialers authenticate the connections instead of issuing tokens.
+type connectorProvider struct {
+	method   AuthMethod
+	instance string
+}
+
+func (c connectorProvider) validate() error {
+	switch c.method {
+	case CloudSQLAuth:
+		if err := validateCloudSQLConfig(c.instance); err != nil {
+			return fmt.Errorf("invalid Cloud SQL config: %w", err)
+		}
+	case AlloyDBAuth:
+		if err := validateAlloyDBConfig(c.instance); err != nil {
+			return fmt.Errorf("invalid AlloyDB config: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (c connectorProvider) generateToken(context.Context) (*authToken, error) {
+	return nil, fmt.Errorf("%s authentication issues no tokens, connections are authenticated by its connector", c.method)
+}
@@ -0,0 +1,51 @@
+// Copyright IBM Corp. 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package pgmultiauth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// requestIDKey is the context key of the request ID of a token fetch.
+type requestIDKey struct{}
+
+// ContextWithRequestID returns a copy of ctx carrying id. Token fetches using
+// the context include it as "request_id" in all their log lines, including
+// those of retries, so that they can be tied to the request connecting. If
+// the context carries no request ID, a random one is generated per fetch.
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the request ID carried by ctx, e.g. within a
+// custom token generator, and reports whether there is one.
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey{}).(string)
+	return id, ok && id != ""
+}
+
+// ensureRequestID returns ctx carrying a request ID, generating one if ctx
+// doesn't carry any yet.
+func ensureRequestID(ctx context.Context) context.Context {
+	if _, ok := RequestIDFromContext(ctx); ok {
+		return ctx
+	}
+
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return ContextWithRequestID(ctx, hex.EncodeToString(b))
+}
+
+// fetchLogFields returns the logging fields of the Config along with the
+// request ID of the token fetch using ctx.
+func (c Config) fetchLogFields(ctx context.Context) []interface{} {
+	fields := c.logFields()
+	if id, ok := RequestIDFromContext(ctx); ok {
+		fields = append(fields, "request_id", id)
+	}
+
+	return fields
+}
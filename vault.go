@@ -0,0 +1,346 @@
+// Copyright IBM Corp. 2025
+// SPDX-License-Identifier: MPL-2.0
+
+package pgmultiauth
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// vaultLogicalReader is the subset of *api.Logical used to read
+// database credentials from Vault.
+type vaultLogicalReader interface {
+	ReadWithContext(ctx context.Context, path string) (*api.Secret, error)
+}
+
+// vaultLeaseRenewer is the subset of *api.Sys used to renew the leases
+// of database credentials.
+type vaultLeaseRenewer interface {
+	RenewWithContext(ctx context.Context, id string, increment int) (*api.Secret, error)
+}
+
+// vaultLease tracks the renewable lease of the credentials last read from
+// Vault. It is shared by copies of a Config so that the lease is renewed
+// instead of issuing new credentials and orphaning the old lease.
+type vaultLease struct {
+	mu       sync.Mutex
+	id       string
+	username string
+	password string
+}
+
+// vaultAppRole logs in to Vault with AppRole credentials. It is shared by
+// copies of a Config so that they use the same Vault token.
+type vaultAppRole struct {
+	roleID   string
+	secretID string
+	mount    string
+
+	mu sync.Mutex
+	// client is a clone of the configured client holding the Vault token
+	client    *api.Client
+	expiry    time.Time
+	renewable bool
+}
+
+// authenticatedClient returns a client holding a valid Vault token. The token
+// is renewed refreshBuffer before it expires, and a new one is issued by
+// logging in again if it can't be renewed.
+func (a *vaultAppRole) authenticatedClient(ctx context.Context, client *api.Client, refreshBuffer time.Duration, clock func() time.Time) (*api.Client, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.client != nil && (a.expiry.IsZero() || validBefore(clock, a.expiry, refreshBuffer)()) {
+		return a.client, nil
+	}
+
+	if a.client != nil && a.renewable {
+		secret, err := a.client.Auth().Token().RenewSelfWithContext(ctx, 0)
+		if err == nil && secret != nil && secret.Auth != nil && time.Duration(secret.Auth.LeaseDuration)*time.Second > refreshBuffer {
+			a.expiry = clock().Add(time.Duration(secret.Auth.LeaseDuration) * time.Second)
+			a.renewable = secret.Auth.Renewable
+			return a.client, nil
+		}
+	}
+
+	loginClient, err := client.Clone()
+	if err != nil {
+		return nil, fmt.Errorf("cloning vault client: %w", err)
+	}
+	loginClient.ClearToken()
+
+	secret, err := loginClient.Logical().WriteWithContext(ctx, "auth/"+a.mount+"/login", map[string]interface{}{
+		"role_id":   a.roleID,
+		"secret_id": a.secretID,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("vault AppRole login: %w", err)
+	}
+
+	if secret == nil || secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return nil, fmt.Errorf("vault AppRole login at %q returned no token", "auth/"+a.mount+"/login")
+	}
+
+	loginClient.SetToken(secret.Auth.ClientToken)
+	a.client = loginClient
+	a.renewable = secret.Auth.Renewable
+	a.expiry = time.Time{}
+	if secret.Auth.LeaseDuration > 0 {
+		a.expiry = clock().Add(time.Duration(secret.Auth.LeaseDuration) * time.Second)
+	}
+
+	return a.client, nil
+}
+
+type vaultTokenConfig struct {
+	logical    vaultLogicalReader
+	secretPath string
+	// Optional, secretPath is the credentials path of the role when set
+	databaseMount string
+	databaseRole  string
+	// Whether the secret must contain a username, as database credentials do
+	requireUser bool
+	// KV secrets engine version of the secret, detected from the response if 0
+	kvVersion int
+
+	// Optional, renewable leases are renewed when both are set
+	sys   vaultLeaseRenewer
+	lease *vaultLease
+
+	// Optional, logs in to get the Vault token used to read the secret
+	client  *api.Client
+	appRole *vaultAppRole
+
+	refreshBuffer time.Duration
+	clock         func() time.Time
+}
+
+func (c vaultTokenConfig) generateToken(ctx context.Context) (*authToken, error) {
+	if c.appRole != nil {
+		client, err := c.appRole.authenticatedClient(ctx, c.client, c.refreshBuffer, c.clock)
+		if err != nil {
+			return nil, err
+		}
+
+		c.logical, c.sys = client.Logical(), client.Sys()
+	}
+
+	if c.sys == nil || c.lease == nil {
+		return c.readToken(ctx)
+	}
+
+	c.lease.mu.Lock()
+	defer c.lease.mu.Unlock()
+
+	if token, ok := c.renewLease(ctx); ok {
+		return token, nil
+	}
+
+	token, secret, err := c.readTokenSecret(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.lease.id = ""
+	if secret.Renewable && secret.LeaseID != "" {
+		c.lease.id = secret.LeaseID
+		c.lease.username = token.username
+		c.lease.password = token.token
+	}
+
+	return token, nil
+}
+
+// renewLease renews the tracked lease and returns its credentials with the
+// extended expiry. It reports false if there is no lease or renewing it
+// failed, in which case the credentials have to be read again.
+func (c vaultTokenConfig) renewLease(ctx context.Context) (*authToken, bool) {
+	if c.lease.id == "" {
+		return nil, false
+	}
+
+	secret, err := c.sys.RenewWithContext(ctx, c.lease.id, 0)
+	// Leases reaching their max TTL are extended by less than the refresh buffer
+	if err != nil || secret == nil || time.Duration(secret.LeaseDuration)*time.Second <= c.refreshBuffer {
+		c.lease.id = ""
+		return nil, false
+	}
+
+	return c.leaseToken(c.lease.password, c.lease.username, secret.LeaseDuration), true
+}
+
+func (c vaultTokenConfig) readToken(ctx context.Context) (*authToken, error) {
+	token, _, err := c.readTokenSecret(ctx)
+	return token, err
+}
+
+func (c vaultTokenConfig) readTokenSecret(ctx context.Context) (*authToken, *api.Secret, error) {
+	secret, err := c.fetchVaultSecret(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("fetching vault secret: %w", err)
+	}
+
+	data, err := c.secretData(secret)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	password, ok := data["password"].(string)
+	if !ok || password == "" {
+		return nil, nil, fmt.Errorf("vault secret at %q does not contain a password", c.secretPath)
+	}
+
+	// Dynamic database credentials come with their own username. It is
+	// optional so that secrets holding only a password can be used as well.
+	username, _ := data["username"].(string)
+	if c.requireUser && username == "" {
+		return nil, nil, fmt.Errorf("vault secret at %q does not contain a username", c.secretPath)
+	}
+
+	return c.leaseToken(password, username, secret.LeaseDuration), secret, nil
+}
+
+// secretData returns the key/value pairs of secret. KV v2 secrets nest them
+// under "data" next to their "metadata", other secrets hold them directly.
+func (c vaultTokenConfig) secretData(secret *api.Secret) (map[string]interface{}, error) {
+	nested, isNested := secret.Data["data"].(map[string]interface{})
+
+	switch c.kvVersion {
+	case 1:
+		return secret.Data, nil
+	case 2:
+		if !isNested {
+			return nil, fmt.Errorf("vault secret at %q is not a KV v2 secret, it has no data", c.secretPath)
+		}
+
+		return nested, nil
+	default:
+		// Deleted KV v2 secrets have metadata but null data
+		if _, hasMetadata := secret.Data["metadata"]; hasMetadata && (isNested || secret.Data["data"] == nil) {
+			return nested, nil
+		}
+
+		return secret.Data, nil
+	}
+}
+
+// leaseToken returns a token for credentials with a lease of leaseDuration seconds.
+func (c vaultTokenConfig) leaseToken(password, username string, leaseDuration int) *authToken {
+	// Secrets without a lease (e.g. static KV secrets) never expire on their own
+	var expiry time.Time
+	validFn := func() bool { return true }
+	if leaseDuration > 0 {
+		// Consider the secret expired refreshBuffer before the lease expires to account for network latency
+		expiry = c.clock().Add(time.Duration(leaseDuration) * time.Second)
+		validFn = validBefore(c.clock, expiry, c.refreshBuffer)
+	}
+
+	return &authToken{token: password, username: username, valid: validFn, expiresAt: expiry}
+}
+
+func (c vaultTokenConfig) fetchVaultSecret(ctx context.Context) (*api.Secret, error) {
+	secret, err := c.logical.ReadWithContext(ctx, c.secretPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading secret: %w", err)
+	}
+
+	if secret == nil || secret.Data == nil {
+		return nil, fmt.Errorf("no secret found at %q", c.secretPath)
+	}
+
+	return secret, nil
+}
+
+// vaultTokenConfig returns the Vault provider of the Config.
+func (c Config) vaultTokenConfig() vaultTokenConfig {
+	tc := vaultTokenConfig{
+		secretPath:    c.vaultPath(),
+		databaseMount: c.vaultDatabaseMount,
+		databaseRole:  c.vaultDatabaseRole,
+		requireUser:   c.vaultDatabaseRole != "",
+		kvVersion:     c.vaultKVVersion,
+		lease:         c.vaultLease,
+		client:        c.vaultClient,
+		appRole:       c.vaultAppRole,
+		refreshBuffer: c.tokenRefreshBuffer,
+		clock:         c.now(),
+	}
+
+	// A missing client is reported by validate
+	if c.vaultClient != nil {
+		tc.logical, tc.sys = c.vaultClient.Logical(), c.vaultClient.Sys()
+	}
+
+	return tc
+}
+
+func (c vaultTokenConfig) validate() error {
+	if err := validateVaultConfig(c.client, c.secretPath, c.databaseMount, c.databaseRole, c.kvVersion); err != nil {
+		return fmt.Errorf("invalid Vault config: %w", err)
+	}
+
+	if err := validateVaultAppRole(c.appRole); err != nil {
+		return fmt.Errorf("invalid Vault config: %w", err)
+	}
+
+	return nil
+}
+
+func validateVaultAppRole(appRole *vaultAppRole) error {
+	if appRole == nil {
+		return nil
+	}
+
+	if appRole.roleID == "" {
+		return fmt.Errorf("vault AppRole role ID is required")
+	}
+
+	if appRole.secretID == "" {
+		return fmt.Errorf("vault AppRole secret ID is required")
+	}
+
+	return nil
+}
+
+// vaultPath returns the path of the secret holding the database credentials.
+func (c Config) vaultPath() string {
+	if c.vaultDatabaseMount == "" && c.vaultDatabaseRole == "" {
+		return c.vaultSecretPath
+	}
+
+	return strings.Trim(c.vaultDatabaseMount, "/") + "/creds/" + c.vaultDatabaseRole
+}
+
+func validateVaultConfig(client *api.Client, secretPath, databaseMount, databaseRole string, kvVersion int) error {
+	if client == nil {
+		return fmt.Errorf("vault client is required for Vault authentication")
+	}
+
+	if kvVersion < 0 || kvVersion > 2 {
+		return fmt.Errorf("vault KV version must be 1 or 2, got %d", kvVersion)
+	}
+
+	if databaseMount != "" || databaseRole != "" {
+		if databaseMount == "" {
+			return fmt.Errorf("vault database secrets engine mount is required for the database role")
+		}
+
+		if databaseRole == "" {
+			return fmt.Errorf("vault database role is required")
+		}
+
+		return nil
+	}
+
+	if secretPath == "" {
+		return fmt.Errorf("vault secret path is required for Vault authentication")
+	}
+
+	return nil
+}